@@ -2,14 +2,19 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"net"
 	"os"
+	"regexp"
 	"text/template"
+
+	"envoy.apiconf"
 )
 
 var (
 	// Route template for gRPC - keeps full path (e.g., /api/FakeService/Handle -> /FakeService/Handle)
 	envoyGrpcRouteTmpl = template.Must(template.New("grpcRouteTmpl").Parse(`
-              - match: { prefix: "{{.APIRoute}}{{.APIName}}" }
+              - match: { path_separated_prefix: "{{.APIRoute}}{{.APIName}}" }
                 route:
                   cluster: {{.ClusterName}}
                   timeout: 0s
@@ -17,17 +22,25 @@ var (
                   max_stream_duration:
                     max_stream_duration: 600s
                     grpc_timeout_header_max: 0s
-{{.RateLimitConfig}}
+{{.FilterConfig}}
 `))
 
-	// Route template for HTTP - strips service name (e.g., /api/game/calculate -> /calculate)
+	// Route template for HTTP - strips service name (e.g., /api/game/calculate -> /calculate),
+	// methods with a path template (e.g., orders/{id}/refund) match the whole path
 	envoyHttpRouteTmpl = template.Must(template.New("httpRouteTmpl").Parse(`
-              - match: { prefix: "{{.APIRoute}}{{.APIName}}" }
+              - match: { {{if .PathRegex}}safe_regex: { regex: {{printf "%q" .PathRegex}} }{{else}}path_separated_prefix: "{{.APIRoute}}{{.APIName}}"{{end}}{{if .Verb}}, headers: [{ name: ":method", string_match: { exact: "{{.Verb}}" } }]{{end}} }
                 route:
                   cluster: {{.ClusterName}}
                   timeout: 30s
+{{- if .PathRegex}}
+                  regex_rewrite:
+                    pattern:
+                      regex: "^{{.APIRoute}}{{.ServiceName}}/(.*)"
+                    substitution: "/\\1"
+{{- else}}
                   prefix_rewrite: "/{{.MethodName}}"
-{{.RateLimitConfig}}
+{{- end}}
+{{.FilterConfig}}
 `))
 
 	// Fallback for API-level routes (matches /api/game/ prefix)
@@ -40,7 +53,7 @@ var (
                     pattern:
                       regex: "^{{.APIRoute}}{{.ServiceName}}/(.*)"
                     substitution: "/\\1"
-{{.RateLimitConfig}}
+{{.FilterConfig}}
 `))
 	envoyGrpcClusterTmpl = template.Must(template.New("grpcClusterTmpl").Parse(`
   - name: {{.ClusterName}}
@@ -92,8 +105,22 @@ var (
             keepalive_interval: 10
 `))
 
+	// Per-route ext_authz settings, no-need routes skip the auth-adapter and drop identity headers
+	// sent by clients, other routes pass their effective auth rule to it as context extensions
+	envoyExtAuthzTmpl = template.Must(template.New("extAuthzTmpl").Parse(
+		`{{if .Disabled}}                request_headers_to_remove: ["user-id", "session-id", "client-id", "service-id"]
+{{end}}                typed_per_filter_config:
+                  envoy.filters.ext_authz:
+                    "@type": type.googleapis.com/envoy.extensions.filters.http.ext_authz.v3.ExtAuthzPerRoute
+{{- if .Disabled}}
+                    disabled: true
+{{- else}}
+                    check_settings:
+                      context_extensions:{{range $k, $v := .ContextExtensions}}
+                        {{$k}}: {{printf "%q" $v}}{{end}}
+{{- end}}{{.RateLimitConfig}}`))
+
 	envoyRateLimitTmpl = template.Must(template.New("rateLimitTmpl").Parse(`
-                typed_per_filter_config:
                   envoy.filters.http.local_ratelimit:
                     "@type": type.googleapis.com/envoy.extensions.filters.http.local_ratelimit.v3.LocalRateLimit
                     stat_prefix: {{.StatPrefix}}
@@ -204,13 +231,33 @@ static_resources:
             typed_config:
                 "@type": type.googleapis.com/envoy.extensions.filters.http.ext_authz.v3.ExtAuthz
                 transport_api_version: V3
+{{- if .AuthAdapterHTTP}}
+                http_service:
+                  server_uri:
+                    uri: http://ext_auth
+                    cluster: ext_auth
+                    timeout: 30s
+                  path_prefix: /authz
+                  authorization_response:
+                    allowed_upstream_headers:
+                      patterns:
+                        - exact: "user-id"
+                        - exact: "session-id"
+                        - exact: "client-id"
+                        - exact: "service-id"
+                    allowed_client_headers_on_success:
+                      patterns:
+                        - exact: "set-cookie"
+{{- else}}
                 grpc_service:
                   timeout: 30s
                   envoy_grpc:
                     cluster_name: ext_auth
+{{- end}}
                 with_request_body:
                   max_request_bytes: 1024
                   allow_partial_message: true
+                include_peer_certificate: true
                 allowed_headers:
                   patterns:
                     - exact: "cookie"
@@ -218,7 +265,8 @@ static_resources:
                     - exact: "x-real-ip"
                     - exact: "x-forwarded-for"
                     - exact: "x-rc-token"
-                    - exact: "x-rc-token-2"
+                    - exact: "x-rc-token-2"{{range .TokenHeaders}}
+                    - exact: "{{.}}"{{end}}
           - name: envoy.filters.http.grpc_web
             typed_config:
               "@type": type.googleapis.com/envoy.extensions.filters.http.grpc_web.v3.GrpcWeb
@@ -229,22 +277,60 @@ static_resources:
   clusters:
   - name: ext_auth
     connect_timeout: 2s
-    type: STRICT_DNS
+    type: {{if .AuthAdapterSocket}}STATIC{{else}}STRICT_DNS{{end}}
+{{- if not .AuthAdapterHTTP}}
     typed_extension_protocol_options:
       envoy.extensions.upstreams.http.v3.HttpProtocolOptions:
         "@type": type.googleapis.com/envoy.extensions.upstreams.http.v3.HttpProtocolOptions
         explicit_http_config:
           http2_protocol_options: {}
+{{- end}}
     lb_policy: ROUND_ROBIN
+    # the auth-adapter reports its readiness, hosts which are not ready get no traffic
+    health_checks:
+      - timeout: 1s
+        interval: 5s
+        unhealthy_threshold: 2
+        healthy_threshold: 1
+{{- if .AuthAdapterHTTP}}
+        http_health_check:
+          path: /ready
+{{- else}}
+        grpc_health_check:
+          service_name: envoy.service.auth.v3.Authorization
+{{- end}}
     load_assignment:
       cluster_name: ext_auth
       endpoints:
         - lb_endpoints:
           - endpoint:
-              address:
+              address:{{if .AuthAdapterSocket}}
+                pipe:
+                  path: "{{.AuthAdapterSocket}}"{{else}}
                 socket_address:
                   address: {{.AuthAdapterHost}}
-                  port_value: 9000
+                  port_value: {{.AuthAdapterPort}}{{end}}
+{{- with .AuthAdapterTLS}}
+    transport_socket:
+      name: envoy.transport_sockets.tls
+      typed_config:
+        "@type": type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.UpstreamTlsContext{{if .ServerName}}
+        sni: "{{.ServerName}}"{{end}}
+        common_tls_context:{{if not $.AuthAdapterHTTP}}
+          alpn_protocols: ["h2"]{{end}}
+          validation_context:
+            trusted_ca:
+              filename: "{{.CAFile}}"{{if .ServerName}}
+            match_typed_subject_alt_names:
+              - san_type: DNS
+                matcher:
+                  exact: "{{.ServerName}}"{{end}}{{if .ClientCertFile}}
+          tls_certificates:
+            - certificate_chain:
+                filename: "{{.ClientCertFile}}"
+              private_key:
+                filename: "{{.ClientKeyFile}}"{{end}}
+{{- end}}
   - name: opentelemetry_collector
     type: STRICT_DNS
     lb_policy: ROUND_ROBIN
@@ -266,7 +352,79 @@ static_resources:
 `))
 )
 
-func GenerateEnvoyConfig(cfg *APIConf, outFile string) error {
+// authAdapterTLS returns the TLS settings of the ext_auth cluster, the auth-adapter certificate
+// is verified by the server name, which is the auth-adapter host unless it is an IP or a unix socket
+func authAdapterTLS(conf *apiconf.AuthAdapterTLSConf, host string, unixSocket bool) *apiconf.AuthAdapterTLSConf {
+	if conf == nil {
+		return nil
+	}
+
+	res := *conf
+	if res.ServerName == "" && !unixSocket && net.ParseIP(host) == nil {
+		res.ServerName = host
+	}
+
+	return &res
+}
+
+// extAuthzConfig renders per-route filter settings of the API method, the empty method
+// stands for the API catch-all route
+func extAuthzConfig(cfg *apiconf.APIConf, service, method, rateLimitConfig string) (string, error) {
+	rule := cfg.RouteRule(service, method)
+
+	data := struct {
+		Disabled          bool
+		ContextExtensions map[string]string
+		RateLimitConfig   string
+	}{
+		// routes without a rule stay checked, the auth-adapter resolves pattern rules or rejects them
+		Disabled: rule != nil && !rule.NeedExtAuthz(),
+		ContextExtensions: map[string]string{
+			apiconf.ContextExtService: service,
+		},
+		RateLimitConfig: rateLimitConfig,
+	}
+	// the method of the catch-all route is known from the path only, the adapter resolves its rule
+	if method != "" {
+		data.ContextExtensions[apiconf.ContextExtMethod] = method
+		if rule != nil && rule.Policy != "" {
+			data.ContextExtensions[apiconf.ContextExtPolicy] = rule.Policy
+		}
+		if rule != nil && rule.Permission != "" {
+			data.ContextExtensions[apiconf.ContextExtPermission] = rule.Permission
+		}
+		if rule != nil && rule.Permissions != nil {
+			expr, err := json.Marshal(rule.Permissions)
+			if err != nil {
+				return "", err
+			}
+			data.ContextExtensions[apiconf.ContextExtPermissions] = string(expr)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := envoyExtAuthzTmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// tokenHeaders returns token headers which are not in the ext_authz allowed_headers list yet
+func tokenHeaders(cfg *apiconf.APIConf) []string {
+	var res []string
+	for _, h := range cfg.TokenHeaders() {
+		switch h {
+		case "cookie", "authorization", "x-real-ip", "x-forwarded-for", "x-rc-token", "x-rc-token-2":
+			continue
+		}
+		res = append(res, h)
+	}
+
+	return res
+}
+
+func GenerateEnvoyConfig(cfg *apiconf.APIConf, outFile string) error {
 	// Build cluster type map for quick lookup
 	clusterTypes := make(map[string]bool) // true = HTTP, false = gRPC
 	for _, cl := range cfg.Clusters {
@@ -274,104 +432,126 @@ func GenerateEnvoyConfig(cfg *APIConf, outFile string) error {
 	}
 
 	routesBuf := new(bytes.Buffer)
-	for _, api := range cfg.APIsDescr {
-		isHTTPCluster := clusterTypes[api.Cluster]
-
-		// Generate route for each method with potential rate limiting
-		for _, method := range api.Methods {
-			routePath := api.Name + "/" + method.Name
-
-			// Generate rate limit config if specified
-			rateLimitConfig := ""
-			if method.Auth != nil && method.Auth.RateLimit != nil {
-				rlData := struct {
-					StatPrefix    string
-					MaxTokens     int
-					TokensPerFill int
-					FillInterval  string
-				}{
-					StatPrefix:    "rate_limit_" + api.Name + "_" + method.Name,
-					MaxTokens:     method.Auth.RateLimit.GetMaxTokens(),
-					TokensPerFill: method.Auth.RateLimit.GetTokensPerFill(),
-					FillInterval:  method.Auth.RateLimit.GetFillIntervalSeconds(),
+	// Routes of longer prefixes go first, Envoy uses the first matching route
+	for _, apiRoute := range cfg.APIPrefixes() {
+		for _, api := range cfg.APIsDescr {
+			isHTTPCluster := clusterTypes[api.Cluster]
+
+			// Generate route for each method with potential rate limiting
+			for _, method := range api.RouteMethods() {
+				routePath := api.Name + "/" + method.Name
+
+				// Generate rate limit config if specified
+				rateLimitConfig := ""
+				if method.Auth != nil && method.Auth.RateLimit != nil {
+					rlData := struct {
+						StatPrefix    string
+						MaxTokens     int
+						TokensPerFill int
+						FillInterval  string
+					}{
+						StatPrefix:    "rate_limit_" + api.Name + "_" + method.Name,
+						MaxTokens:     maxTokens(method.Auth.RateLimit),
+						TokensPerFill: tokensPerFill(method.Auth.RateLimit),
+						FillInterval:  fillInterval(method.Auth.RateLimit),
+					}
+
+					rlBuf := new(bytes.Buffer)
+					err := envoyRateLimitTmpl.Execute(rlBuf, rlData)
+					if err != nil {
+						return err
+					}
+					rateLimitConfig = rlBuf.String()
 				}
 
-				rlBuf := new(bytes.Buffer)
-				err := envoyRateLimitTmpl.Execute(rlBuf, rlData)
+				filterConfig, err := extAuthzConfig(cfg, api.Name, method.Name, rateLimitConfig)
 				if err != nil {
 					return err
 				}
-				rateLimitConfig = rlBuf.String()
-			}
 
-			// Choose template based on cluster type
-			var routeTmpl *template.Template
-			if isHTTPCluster {
-				routeTmpl = envoyHttpRouteTmpl
-			} else {
-				routeTmpl = envoyGrpcRouteTmpl
-			}
+				// Choose template based on cluster type
+				var routeTmpl *template.Template
+				if isHTTPCluster {
+					routeTmpl = envoyHttpRouteTmpl
+				} else {
+					routeTmpl = envoyGrpcRouteTmpl
+				}
 
-			routeData := struct {
-				APIRoute        string
-				APIName         string
-				MethodName      string
-				ServiceName     string
-				ClusterName     string
-				RateLimitConfig string
-			}{
-				APIRoute:        cfg.APIRoute,
-				APIName:         routePath,
-				MethodName:      method.Name,
-				ServiceName:     api.Name,
-				ClusterName:     api.Cluster,
-				RateLimitConfig: rateLimitConfig,
-			}
+				pathRegex := ""
+				if method.Path != "" {
+					pathRegex = "^" + regexp.QuoteMeta(apiRoute+api.Name+"/") + method.PathRegex() + "$"
+				}
 
-			err := routeTmpl.Execute(routesBuf, routeData)
-			if err != nil {
-				return err
-			}
-		}
+				routeData := struct {
+					APIRoute     string
+					APIName      string
+					MethodName   string
+					ServiceName  string
+					ClusterName  string
+					Verb         string
+					PathRegex    string
+					FilterConfig string
+				}{
+					APIRoute:     apiRoute,
+					APIName:      routePath,
+					MethodName:   method.Name,
+					ServiceName:  api.Name,
+					ClusterName:  api.Cluster,
+					Verb:         method.Verb,
+					PathRegex:    pathRegex,
+					FilterConfig: filterConfig,
+				}
 
-		// Also generate route for the API itself (without method) - catch-all for HTTP
-		if isHTTPCluster {
-			// For HTTP clusters, use regex rewrite to strip service name
-			routeData := struct {
-				APIRoute        string
-				ServiceName     string
-				ClusterName     string
-				RateLimitConfig string
-			}{
-				APIRoute:        cfg.APIRoute,
-				ServiceName:     api.Name,
-				ClusterName:     api.Cluster,
-				RateLimitConfig: "",
+				err = routeTmpl.Execute(routesBuf, routeData)
+				if err != nil {
+					return err
+				}
 			}
-			err := envoyHttpApiRouteTmpl.Execute(routesBuf, routeData)
+
+			// Also generate route for the API itself (without method) - catch-all for HTTP
+			filterConfig, err := extAuthzConfig(cfg, api.Name, "", "")
 			if err != nil {
 				return err
 			}
-		} else {
-			// For gRPC clusters, keep original behavior
-			routeData := struct {
-				APIRoute        string
-				APIName         string
-				MethodName      string
-				ServiceName     string
-				ClusterName     string
-				RateLimitConfig string
-			}{
-				APIRoute:        cfg.APIRoute,
-				APIName:         api.Name,
-				MethodName:      "",
-				ServiceName:     api.Name,
-				ClusterName:     api.Cluster,
-				RateLimitConfig: "",
-			}
-			err := envoyGrpcRouteTmpl.Execute(routesBuf, routeData)
-			if err != nil {
-				return err
+
+			if isHTTPCluster {
+				// For HTTP clusters, use regex rewrite to strip service name
+				routeData := struct {
+					APIRoute     string
+					ServiceName  string
+					ClusterName  string
+					FilterConfig string
+				}{
+					APIRoute:     apiRoute,
+					ServiceName:  api.Name,
+					ClusterName:  api.Cluster,
+					FilterConfig: filterConfig,
+				}
+				err := envoyHttpApiRouteTmpl.Execute(routesBuf, routeData)
+				if err != nil {
+					return err
+				}
+			} else {
+				// For gRPC clusters, keep original behavior
+				routeData := struct {
+					APIRoute     string
+					APIName      string
+					MethodName   string
+					ServiceName  string
+					ClusterName  string
+					FilterConfig string
+				}{
+					APIRoute:     apiRoute,
+					APIName:      api.Name,
+					MethodName:   "",
+					ServiceName:  api.Name,
+					ClusterName:  api.Cluster,
+					FilterConfig: filterConfig,
+				}
+				err := envoyGrpcRouteTmpl.Execute(routesBuf, routeData)
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -457,12 +637,18 @@ func GenerateEnvoyConfig(cfg *APIConf, outFile string) error {
 	tmplData := struct {
 		Routes            string
 		Clusters          string
+		TokenHeaders      []string
 		AuthAdapterHost   string
+		AuthAdapterPort   int
+		AuthAdapterSocket string
+		AuthAdapterTLS    *apiconf.AuthAdapterTLSConf
+		AuthAdapterHTTP   bool
 		OpenTelemetryHost string
 		OpenTelemetryPort string
 	}{
 		Routes:            string(routesBuf.Bytes()),
 		Clusters:          string(clustersBuf.Bytes()),
+		TokenHeaders:      tokenHeaders(cfg),
 		AuthAdapterHost:   "127.0.0.1",
 		OpenTelemetryHost: "127.0.0.1",
 		OpenTelemetryPort: "4317",
@@ -472,6 +658,20 @@ func GenerateEnvoyConfig(cfg *APIConf, outFile string) error {
 		tmplData.AuthAdapterHost = authAdapterHost
 	}
 
+	// envoy dials the auth-adapter where it listens, the HTTP endpoint with the http protocol
+	tmplData.AuthAdapterHTTP = cfg.AuthAdapter.HTTP()
+	listen := cfg.AuthAdapter.GatewayListen()
+	if socket, ok := apiconf.ListenSocket(listen); ok {
+		tmplData.AuthAdapterSocket = socket
+	} else {
+		port, err := apiconf.ListenPort(listen)
+		if err != nil {
+			return err
+		}
+		tmplData.AuthAdapterPort = port
+	}
+	tmplData.AuthAdapterTLS = authAdapterTLS(cfg.AuthAdapter.GetTLS(), tmplData.AuthAdapterHost, tmplData.AuthAdapterSocket != "")
+
 	if otHost := os.Getenv("OPEN_TELEMETRY_HOST"); otHost != "" {
 		tmplData.OpenTelemetryHost = otHost
 	}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"envoy.apiconf"
+	"gopkg.in/yaml.v3"
+)
+
+// apiRouteCase is shared with the auth-adapter tests, see envoy/testdata/api_routes.yaml
+type apiRouteCase struct {
+	Name     string            `yaml:"name"`
+	APIRoute apiconf.APIRoutes `yaml:"api_route"`
+	Path     string            `yaml:"path"`
+	Service  string            `yaml:"service"`
+	Method   string            `yaml:"method"`
+}
+
+// generatedRoutes returns the generated routes in Envoy matching order
+func generatedRoutes(t *testing.T, file string) []map[string]interface{} {
+	t.Helper()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("generated config is not valid YAML: %v", err)
+	}
+
+	var res []map[string]interface{}
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			if _, ok := v["match"].(map[string]interface{}); ok {
+				res = append(res, v)
+				return
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(doc)
+
+	return res
+}
+
+// routeMatch returns the route matcher when the route matches the request
+func routeMatch(route map[string]interface{}, verb, path string) (string, bool) {
+	m := route["match"].(map[string]interface{})
+	if headers, ok := m["headers"].([]interface{}); ok {
+		for _, h := range headers {
+			h := h.(map[string]interface{})
+			exact := h["string_match"].(map[string]interface{})["exact"]
+			if h["name"] == ":method" && exact != verb {
+				return "", false
+			}
+		}
+	}
+
+	if p, ok := m["prefix"].(string); ok {
+		return p, strings.HasPrefix(path, p)
+	}
+	if p, ok := m["path_separated_prefix"].(string); ok {
+		return p, path == p || strings.HasPrefix(path, p+"/")
+	}
+	if re, ok := m["safe_regex"].(map[string]interface{}); ok {
+		p := re["regex"].(string)
+		return p, regexp.MustCompile(p).MatchString(path)
+	}
+
+	return "", false
+}
+
+// findRoute returns the first generated route matching the request, nil when nothing matches
+func findRoute(routes []map[string]interface{}, verb, path string) (map[string]interface{}, string) {
+	if idx := strings.Index(path, "?"); idx != -1 {
+		path = path[:idx]
+	}
+
+	for _, r := range routes {
+		if p, ok := routeMatch(r, verb, path); ok {
+			return r, p
+		}
+	}
+
+	return nil, ""
+}
+
+func TestGenerateEnvoyConfigAPIRoutes(t *testing.T) {
+	data, err := os.ReadFile("../testdata/api_routes.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cases []apiRouteCase
+	if err := yaml.Unmarshal(data, &cases); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			service, method := "FakeService", "Handle"
+			if tt.Method != "" {
+				service, method = tt.Service, strings.TrimPrefix(tt.Method, tt.Service+"/")
+			}
+
+			cfg, err := apiconf.Parse([]byte(fmt.Sprintf(`
+api_route: [%s]
+clusters:
+  - name: backend
+    addr: "backend:9000"
+apis:
+  - name: %s
+    cluster: backend
+    methods:
+      - name: %s
+`, strings.Join(tt.APIRoute, ", "), service, method)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cfg.ValidateClusters(); err != nil {
+				t.Fatal(err)
+			}
+
+			out := filepath.Join(t.TempDir(), "envoy.yaml")
+			if err := GenerateEnvoyConfig(cfg, out); err != nil {
+				t.Fatal(err)
+			}
+
+			_, matched := findRoute(generatedRoutes(t, out), "POST", tt.Path)
+
+			if tt.Method == "" {
+				if matched != "" {
+					t.Errorf("path %s is routed by %s, want no route", tt.Path, matched)
+				}
+				return
+			}
+
+			// the method route must win, the adapter checks the same method
+			if !strings.HasSuffix(matched, "/"+tt.Method) {
+				t.Errorf("path %s is routed by %q, want route of %s", tt.Path, matched, tt.Method)
+			}
+		})
+	}
+}
+
+func TestGenerateEnvoyConfigExtAuthzPerRoute(t *testing.T) {
+	cfg, err := apiconf.Parse([]byte(`
+clusters:
+  - name: backend
+    addr: "backend:9000"
+apis:
+  - name: Health
+    cluster: backend
+    auth:
+      policy: no-need
+    methods:
+      - name: Check
+  - name: Users
+    cluster: backend
+    methods:
+      - name: Get
+        auth:
+          policy: required
+          permission: "user:read"
+      - name: GetAll
+        auth:
+          policy: no-need
+          need_recaptcha: true
+      - name: Ping
+        auth:
+          policy: no-need
+      - name: Update
+        auth:
+          policy: required
+          permissions: {any_of: ["user:write", "admin"]}
+  - name: Console
+    cluster: backend
+    auth:
+      policy: no-need
+    methods:
+      - name: Status
+      - name: Admin*
+        auth:
+          policy: required
+          permission: admin
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.ValidateClusters(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(t.TempDir(), "envoy.yaml")
+	if err := GenerateEnvoyConfig(cfg, out); err != nil {
+		t.Fatal(err)
+	}
+	routes := generatedRoutes(t, out)
+
+	tests := []struct {
+		path       string
+		disabled   bool
+		extensions map[string]interface{}
+	}{
+		{path: "/api/Health/Check", disabled: true},
+		{path: "/api/Health/Other", disabled: true},
+		{path: "/api/Users/Ping", disabled: true},
+		{path: "/api/Users/Get", extensions: map[string]interface{}{
+			"service": "Users", "method": "Get", "policy": "required", "permission": "user:read",
+		}},
+		{path: "/api/Users/Update", extensions: map[string]interface{}{
+			"service": "Users", "method": "Update", "policy": "required", "permissions": `{"any_of":["user:write","admin"]}`,
+		}},
+		// no-need with reCaptcha still goes through the adapter, the Get route must not match it
+		{path: "/api/Users/GetAll", extensions: map[string]interface{}{
+			"service": "Users", "method": "GetAll", "policy": "no-need",
+		}},
+		// the adapter rejects methods without auth rules
+		{path: "/api/Users/Other", extensions: map[string]interface{}{"service": "Users"}},
+		// pattern rules are resolved by the adapter, routes without own rules can't skip it
+		{path: "/api/Console/Status", extensions: map[string]interface{}{"service": "Console", "method": "Status"}},
+		{path: "/api/Console/AdminUsers", extensions: map[string]interface{}{"service": "Console"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			route, _ := findRoute(routes, "POST", tt.path)
+			if route == nil {
+				t.Fatalf("no route for %s", tt.path)
+			}
+
+			perRoute, _ := route["typed_per_filter_config"].(map[string]interface{})
+			extAuthz, ok := perRoute["envoy.filters.ext_authz"].(map[string]interface{})
+			if !ok {
+				t.Fatalf("route of %s has no ext_authz settings", tt.path)
+			}
+
+			disabled, _ := extAuthz["disabled"].(bool)
+			if disabled != tt.disabled {
+				t.Fatalf("ext_authz disabled = %v, want %v", disabled, tt.disabled)
+			}
+
+			removed := fmt.Sprint(route["request_headers_to_remove"])
+			if tt.disabled {
+				if !strings.Contains(removed, "user-id") {
+					t.Errorf("identity headers are not removed on the route without ext_authz: %s", removed)
+				}
+				return
+			}
+
+			settings, _ := extAuthz["check_settings"].(map[string]interface{})
+			extensions, _ := settings["context_extensions"].(map[string]interface{})
+			if fmt.Sprint(extensions) != fmt.Sprint(tt.extensions) {
+				t.Errorf("context extensions = %v, want %v", extensions, tt.extensions)
+			}
+		})
+	}
+}
+
+func TestGenerateEnvoyConfigHTTPMethods(t *testing.T) {
+	cfg, err := apiconf.Parse([]byte(`
+clusters:
+  - name: payments
+    addr: "payments:8080"
+    type: http
+apis:
+  - name: PaymentAPI
+    cluster: payments
+    methods:
+      - name: charge
+        verb: POST
+      - name: getCharge
+        verb: GET
+        path: charge
+      - name: refund
+        verb: POST
+        path: orders/{id}/refund
+      - name: order
+        path: orders/{id}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.ValidateClusters(); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(t.TempDir(), "envoy.yaml")
+	if err := GenerateEnvoyConfig(cfg, out); err != nil {
+		t.Fatal(err)
+	}
+	routes := generatedRoutes(t, out)
+
+	tests := []struct {
+		verb   string
+		path   string
+		method string
+	}{
+		{"POST", "/api/PaymentAPI/charge", "charge"},
+		{"POST", "/api/PaymentAPI/charge/card", "charge"},
+		{"GET", "/api/PaymentAPI/charge?id=1", "getCharge"},
+		{"GET", "/api/PaymentAPI/charge/card", ""},
+		{"POST", "/api/PaymentAPI/orders/42/refund", "refund"},
+		{"GET", "/api/PaymentAPI/orders/42/refund", ""},
+		{"DELETE", "/api/PaymentAPI/orders/42", "order"},
+		{"GET", "/api/PaymentAPI/orders", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.verb+" "+tt.path, func(t *testing.T) {
+			route, matched := findRoute(routes, tt.verb, tt.path)
+			if route == nil {
+				t.Fatalf("no route for %s %s", tt.verb, tt.path)
+			}
+
+			perRoute := route["typed_per_filter_config"].(map[string]interface{})
+			settings, _ := perRoute["envoy.filters.ext_authz"].(map[string]interface{})["check_settings"].(map[string]interface{})
+			extensions, _ := settings["context_extensions"].(map[string]interface{})
+			// the catch-all route passes no method, the adapter applies the API rule
+			method, _ := extensions["method"].(string)
+			if method != tt.method {
+				t.Errorf("%s %s is routed by %s to method %q, want %q", tt.verb, tt.path, matched, method, tt.method)
+			}
+		})
+	}
+}
+
+// extAuthCluster generates the Envoy config and returns its ext_auth cluster
+func extAuthCluster(t *testing.T, conf string) map[string]interface{} {
+	t.Helper()
+
+	cfg, err := apiconf.Parse([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(t.TempDir(), "envoy.yaml")
+	if err := GenerateEnvoyConfig(cfg, out); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		StaticResources struct {
+			Clusters []map[string]interface{} `yaml:"clusters"`
+		} `yaml:"static_resources"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("generated config is not valid YAML: %v", err)
+	}
+
+	for _, c := range doc.StaticResources.Clusters {
+		if c["name"] == "ext_auth" {
+			return c
+		}
+	}
+	t.Fatal("ext_auth cluster is not generated")
+
+	return nil
+}
+
+// lookup returns the value at the path of map keys and list indexes
+func lookup(v interface{}, path ...interface{}) interface{} {
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			m, _ := v.(map[string]interface{})
+			v = m[p]
+		case int:
+			l, _ := v.([]interface{})
+			if p >= len(l) {
+				return nil
+			}
+			v = l[p]
+		}
+	}
+
+	return v
+}
+
+func TestGenerateEnvoyConfigExtAuthCluster(t *testing.T) {
+	t.Setenv("AUTH_ADAPTER_HOST", "auth-adapter")
+	endpoint := []interface{}{"load_assignment", "endpoints", 0, "lb_endpoints", 0, "endpoint", "address"}
+	tlsContext := []interface{}{"transport_socket", "typed_config"}
+
+	tests := []struct {
+		name string
+		conf string
+		path []interface{}
+		want interface{}
+	}{
+		{
+			name: "grpc health check",
+			path: []interface{}{"health_checks", 0, "grpc_health_check", "service_name"},
+			want: "envoy.service.auth.v3.Authorization",
+		},
+		{
+			name: "default port",
+			path: append(endpoint, "socket_address", "port_value"),
+			want: 9000,
+		},
+		{
+			name: "listen port",
+			conf: `auth_adapter: {listen: "0.0.0.0:9443"}`,
+			path: append(endpoint, "socket_address", "port_value"),
+			want: 9443,
+		},
+		{
+			name: "unix socket",
+			conf: `auth_adapter: {listen: "unix:/run/auth/authz.sock"}`,
+			path: append(endpoint, "pipe", "path"),
+			want: "/run/auth/authz.sock",
+		},
+		{
+			name: "http protocol port",
+			conf: `auth_adapter: {http_listen: ":9002", protocol: http}`,
+			path: append(endpoint, "socket_address", "port_value"),
+			want: 9002,
+		},
+		{
+			name: "http protocol health check",
+			conf: `auth_adapter: {http_listen: ":9002", protocol: http}`,
+			path: []interface{}{"health_checks", 0, "http_health_check", "path"},
+			want: "/ready",
+		},
+		{
+			name: "plaintext",
+			path: tlsContext,
+			want: nil,
+		},
+		{
+			name: "tls server name is the host",
+			conf: `auth_adapter: {tls: {cert_file: a.crt, key_file: a.key, ca_file: ca.crt}}`,
+			path: append(tlsContext, "sni"),
+			want: "auth-adapter",
+		},
+		{
+			name: "mtls envoy certificate",
+			conf: `auth_adapter: {tls: {cert_file: a.crt, key_file: a.key, ca_file: ca.crt, client_ca_file: ca.crt,
+  client_cert_file: envoy.crt, client_key_file: envoy.key}}`,
+			path: append(tlsContext, "common_tls_context", "tls_certificates", 0, "certificate_chain", "filename"),
+			want: "envoy.crt",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := extAuthCluster(t, tt.conf+`
+clusters:
+  - name: backend
+    addr: "backend:9000"
+apis:
+  - name: Users
+    cluster: backend
+`)
+			if got := lookup(cluster, tt.path...); got != tt.want {
+				t.Errorf("%v = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenHeadersCaptchaProviders(t *testing.T) {
+	cfg, err := apiconf.Parse([]byte(`
+apis:
+  - name: Users
+    auth: {policy: no-need, need_recaptcha: true, captcha_provider: hcaptcha}
+captcha:
+  provider: turnstile
+  turnstile: {token_header: X-Captcha}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := strings.Join(tokenHeaders(cfg), ",")
+	if want := "x-captcha,x-turnstile-token,x-hcaptcha-token"; got != want {
+		t.Errorf("tokenHeaders() = %s, want %s", got, want)
+	}
+}
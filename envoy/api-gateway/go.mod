@@ -1,5 +1,10 @@
 module api-config
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	envoy.apiconf v0.0.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 go 1.25
+
+replace envoy.apiconf => ../apiconf
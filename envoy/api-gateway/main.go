@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+
+	"envoy.apiconf"
 )
 
 var (
@@ -14,6 +16,13 @@ var (
 func init() {
 	flag.StringVar(&apiConfPath, "api-conf", "config.yaml", "API config file path")
 	flag.StringVar(&envoyConfOutPath, "out-envoy-conf", "conf_out.yaml", "out Envoy config file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags]\n"+
+			"       %s lint [-api-conf config.yaml]  check the config strictly\n"+
+			"       %s schema                        print JSON Schema of the config\n",
+			os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
 }
 
 func main() {
@@ -23,6 +32,21 @@ func main() {
 			os.Exit(1)
 		}
 	}()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "lint":
+			os.Exit(lint(os.Args[2:]))
+		case "schema":
+			schema, err := apiconf.Schema()
+			if err != nil {
+				panic(err)
+			}
+			os.Stdout.Write(schema)
+			return
+		}
+	}
+
 	flag.Parse()
 
 	c, err := LoadConfig(apiConfPath)
@@ -30,10 +54,6 @@ func main() {
 		panic(err)
 	}
 
-	if err := c.Validate(); err != nil {
-		panic(err)
-	}
-
 	err = GenerateEnvoyConfig(c, envoyConfOutPath)
 	if err != nil {
 		panic(err)
@@ -41,3 +61,27 @@ func main() {
 
 	fmt.Println("done")
 }
+
+// lint prints config issues as file:line:column: severity: message, it fails on errors only
+func lint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	file := fs.String("api-conf", "config.yaml", "API config file path")
+	fs.Parse(args)
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	issues := apiconf.Lint(data)
+	for _, issue := range issues {
+		fmt.Printf("%s:%s\n", *file, issue)
+	}
+
+	if apiconf.HasErrors(issues) {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,328 @@
+package apiconf
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// auth policies
+	PolicyRequired = "required"
+	PolicyOptional = "optional"
+	PolicyNoNeed   = "no-need"
+	PolicyAPIKey   = "api-key"
+	PolicyMTLS     = "mtls"
+
+	// behaviour when the auth backend is unavailable
+	OnUnavailableDeny           = "deny"
+	OnUnavailableAllowAnonymous = "allow_anonymous"
+
+	// rule modes, shadow rules log and count denials and let the request through
+	ModeEnforce = "enforce"
+	ModeShadow  = "shadow"
+
+	// ext_authz context extensions the gateway sets per route
+	ContextExtService     = "service"
+	ContextExtMethod      = "method"
+	ContextExtPolicy      = "policy"
+	ContextExtPermission  = "permission"
+	ContextExtPermissions = "permissions" // PermissionExpr in JSON
+)
+
+type RateLimitConf struct {
+	Period time.Duration `yaml:"period"`
+	Count  int           `yaml:"count"`
+	Delay  time.Duration `yaml:"delay"`
+	Mode   string        `yaml:"mode" enum:"enforce,shadow"`
+}
+
+func (c *RateLimitConf) Validate() error {
+	if c.Count <= 0 {
+		return fmt.Errorf("rate limit count must be positive")
+	}
+
+	if c.Period <= 0 {
+		return fmt.Errorf("rate limit period must be positive")
+	}
+
+	if c.Delay < 0 {
+		return fmt.Errorf("rate limit delay cannot be negative")
+	}
+
+	return validateMode(c.Mode)
+}
+
+// Shadow tells whether requests over the limit are only logged and counted
+func (c *RateLimitConf) Shadow() bool {
+	return c.Mode == ModeShadow
+}
+
+func validateMode(mode string) error {
+	switch mode {
+	case "", ModeEnforce, ModeShadow:
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %s", mode)
+	}
+}
+
+// TokenSourceConf describes one place the session token is taken from,
+// exactly one of Cookie, Header or Query is set
+type TokenSourceConf struct {
+	Cookie string `yaml:"cookie"`
+	Header string `yaml:"header"`
+	Scheme string `yaml:"scheme"` // optional header value prefix, e.g. Bearer
+	Query  string `yaml:"query"`  // for websockets where headers can't be set
+}
+
+func (c TokenSourceConf) Valid() bool {
+	set := 0
+	for _, v := range []string{c.Cookie, c.Header, c.Query} {
+		if v != "" {
+			set++
+		}
+	}
+
+	return set == 1 && (c.Scheme == "" || c.Header != "")
+}
+
+// String is used as the token source name in logs and traces
+func (c TokenSourceConf) String() string {
+	switch {
+	case c.Cookie != "":
+		return "cookie:" + c.Cookie
+	case c.Header != "":
+		return "header:" + strings.ToLower(c.Header)
+	default:
+		return "query:" + c.Query
+	}
+}
+
+// DefaultTokenSources are used when an API doesn't configure token_sources
+var DefaultTokenSources = []TokenSourceConf{
+	{Cookie: "token"},
+	{Header: "authorization", Scheme: "Bearer"},
+}
+
+type AuthConf struct {
+	Policy      string          `yaml:"policy" enum:"required,optional,no-need,api-key,mtls"`
+	Permission  string          `yaml:"permission"`
+	Permissions *PermissionExpr `yaml:"permissions"`
+	ReCaptcha   ReCaptchaConf   `yaml:"need_recaptcha"`
+	// recaptcha | hcaptcha | turnstile, by default the captcha.provider
+	CaptchaProvider string            `yaml:"captcha_provider" enum:"recaptcha,hcaptcha,turnstile"`
+	RateLimit       *RateLimitConf    `yaml:"rate_limit"`
+	TokenSources    []TokenSourceConf `yaml:"token_sources"`
+	Validator       string            `yaml:"validator" enum:"session,jwt,introspection"`
+	// deny | allow_anonymous, by default required policy denies and others allow anonymous access
+	OnAuthUnavailable string `yaml:"on_auth_unavailable" enum:"deny,allow_anonymous"`
+	// enforce | shadow, the rate limit has its own mode
+	Mode string `yaml:"mode" enum:"enforce,shadow"`
+}
+
+func (c AuthConf) NoNeed() bool {
+	return c.Policy == PolicyNoNeed
+}
+
+func (c AuthConf) Optional() bool {
+	return c.Policy == PolicyOptional
+}
+
+func (c AuthConf) Required() bool {
+	return c.Policy == PolicyRequired
+}
+
+func (c AuthConf) APIKey() bool {
+	return c.Policy == PolicyAPIKey
+}
+
+func (c AuthConf) MTLS() bool {
+	return c.Policy == PolicyMTLS
+}
+
+// AllowAnonymousOnUnavailable tells whether to let the request through without identity
+// when its token can't be checked because of the auth backend failure, required rules are always
+// denied: the policy of the gateway route may override the configured one
+func (c AuthConf) AllowAnonymousOnUnavailable() bool {
+	switch c.OnAuthUnavailable {
+	case OnUnavailableAllowAnonymous:
+		return !c.Required()
+	case OnUnavailableDeny:
+		return false
+	default:
+		return c.NoNeed() || c.Optional()
+	}
+}
+
+// Shadow tells whether denials of the rule are only logged and counted
+func (c AuthConf) Shadow() bool {
+	return c.Mode == ModeShadow
+}
+
+func (c AuthConf) NeedReCaptcha() bool {
+	return c.ReCaptcha.Enabled
+}
+
+// NeedExtAuthz tells whether the gateway must call the auth-adapter for the rule,
+// no-need routes still go through it for rate limits and reCaptcha
+func (c AuthConf) NeedExtAuthz() bool {
+	return !c.NoNeed() || c.RateLimit != nil || c.ReCaptcha.Enabled
+}
+
+// GetTokenSources returns token sources in priority order
+func (c AuthConf) GetTokenSources() []TokenSourceConf {
+	if len(c.TokenSources) == 0 {
+		return DefaultTokenSources
+	}
+
+	return c.TokenSources
+}
+
+// Validate checks the rule itself, the validator mode is checked against token_validator by APIConf
+func (c *AuthConf) Validate() error {
+	switch c.Policy {
+	case PolicyRequired, PolicyOptional, PolicyNoNeed, PolicyAPIKey, PolicyMTLS:
+	default:
+		return fmt.Errorf("unknown auth policy %s", c.Policy)
+	}
+
+	if c.Permission != "" {
+		if err := validatePermission(c.Permission); err != nil {
+			return err
+		}
+	}
+
+	if c.Permissions != nil {
+		if err := c.Permissions.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, ts := range c.TokenSources {
+		if !ts.Valid() {
+			return fmt.Errorf("invalid token source %+v, exactly one of cookie, header or query must be set "+
+				"and scheme can be used only with header", ts)
+		}
+	}
+
+	switch c.OnAuthUnavailable {
+	case "", OnUnavailableDeny:
+	case OnUnavailableAllowAnonymous:
+		if c.Required() {
+			return fmt.Errorf("on_auth_unavailable %s can't be used with %s policy", c.OnAuthUnavailable, c.Policy)
+		}
+	default:
+		return fmt.Errorf("unknown on_auth_unavailable %s", c.OnAuthUnavailable)
+	}
+
+	if err := validateMode(c.Mode); err != nil {
+		return err
+	}
+
+	if c.RateLimit != nil {
+		if err := c.RateLimit.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.ReCaptcha.Validate(); err != nil {
+		return fmt.Errorf("invalid need_recaptcha: %w", err)
+	}
+
+	if err := checkCaptchaProvider(c.CaptchaProvider); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ReCaptchaConf is the need_recaptcha value: true checks reCaptcha v3 tokens with the default
+// min score, an object also sets the expected action and the sites the token may come from
+type ReCaptchaConf struct {
+	MinScore *float64 `yaml:"min_score"` // RECAPTCHA_MIN_SCORE of the auth-adapter by default
+	Action   string   `yaml:"action"`    // not checked when empty
+	// hostnames of the sites the token is issued for, any when empty, they are checked for v2 tokens too
+	Hostnames []string `yaml:"hostnames"`
+
+	// set by need_recaptcha: true or an object
+	Enabled bool `yaml:"-"`
+}
+
+func (c *ReCaptchaConf) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*c = ReCaptchaConf{}
+		return value.Decode(&c.Enabled)
+	}
+
+	type plain ReCaptchaConf
+	var res plain
+	if err := value.Decode(&res); err != nil {
+		return err
+	}
+	*c = ReCaptchaConf(res)
+	c.Enabled = true
+
+	return nil
+}
+
+func (c ReCaptchaConf) Validate() error {
+	if c.MinScore != nil && (*c.MinScore < 0 || *c.MinScore > 1) {
+		return fmt.Errorf("min_score must be between 0 and 1")
+	}
+
+	for _, h := range c.Hostnames {
+		if h == "" {
+			return fmt.Errorf("empty hostname")
+		}
+	}
+
+	return nil
+}
+
+// GetMinScore returns the min score of v3 tokens, def when it is not set for the method
+func (c ReCaptchaConf) GetMinScore(def float64) float64 {
+	if c.MinScore == nil {
+		return def
+	}
+
+	return *c.MinScore
+}
+
+// AllowHostname tells whether the token issued for the site is accepted
+func (c ReCaptchaConf) AllowHostname(hostname string) bool {
+	if len(c.Hostnames) == 0 {
+		return true
+	}
+
+	for _, h := range c.Hostnames {
+		if strings.EqualFold(h, hostname) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inherit copies settings which are set per API to the method rule, required methods
+// don't take allow_anonymous of the API
+func (c *AuthConf) inherit(api *AuthConf) {
+	if api == nil {
+		return
+	}
+
+	if len(c.TokenSources) == 0 {
+		c.TokenSources = api.TokenSources
+	}
+	if c.Validator == "" {
+		c.Validator = api.Validator
+	}
+	if c.OnAuthUnavailable == "" && !(c.Required() && api.OnAuthUnavailable == OnUnavailableAllowAnonymous) {
+		c.OnAuthUnavailable = api.OnAuthUnavailable
+	}
+	if c.CaptchaProvider == "" {
+		c.CaptchaProvider = api.CaptchaProvider
+	}
+}
@@ -0,0 +1,495 @@
+package apiconf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// token validator modes
+	ValidatorSession       = "session"
+	ValidatorJWT           = "jwt"
+	ValidatorIntrospection = "introspection"
+
+	DefaultAuthBackendTimeout = 5 * time.Second
+	DefaultAPIKeyHeader       = "x-api-key"
+	DefaultPolicyQuery        = "data.authz.decision"
+	DefaultAuditMaxSize       = 100 // MB
+	DefaultAuditMaxBackups    = 5
+	DefaultAuthAdapterListen  = ":9000"
+
+	// ext_authz protocols of the auth-adapter
+	ProtocolGRPC = "grpc"
+	ProtocolHTTP = "http"
+
+	// unixSocketPrefix marks the listen address of the auth-adapter as a unix domain socket path
+	unixSocketPrefix = "unix:"
+)
+
+type JWTClaimsConf struct {
+	UserID      string `yaml:"user_id"`     // default: sub
+	SessionID   string `yaml:"session_id"`  // default: sid
+	Roles       string `yaml:"roles"`       // default: roles
+	Permissions string `yaml:"permissions"` // default: permissions
+}
+
+type JWTConfig struct {
+	JWKSURL         string        `yaml:"jwks_url"`
+	JWKSFile        string        `yaml:"jwks_file"`
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	Issuer          string        `yaml:"issuer"`
+	Audience        []string      `yaml:"audience"`
+	Leeway          time.Duration `yaml:"leeway"`
+	Claims          JWTClaimsConf `yaml:"claims"`
+}
+
+func (c *JWTConfig) Validate() error {
+	if (c.JWKSURL == "") == (c.JWKSFile == "") {
+		return fmt.Errorf("exactly one of jwks_url or jwks_file must be set")
+	}
+
+	if c.RefreshInterval < 0 || c.Leeway < 0 {
+		return fmt.Errorf("refresh_interval and leeway cannot be negative")
+	}
+
+	return nil
+}
+
+type IntrospectionConfig struct {
+	URL          string        `yaml:"url"`
+	ClientID     string        `yaml:"client_id"`
+	ClientSecret string        `yaml:"client_secret"`
+	MaxCacheTTL  time.Duration `yaml:"max_cache_ttl"`
+	// ScopePermissions maps a scope to permissions, scopes without mapping are used as permissions as is
+	ScopePermissions map[string][]string `yaml:"scope_permissions"`
+}
+
+func (c *IntrospectionConfig) Validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("introspection url is not set")
+	}
+
+	if _, err := url.ParseRequestURI(c.URL); err != nil {
+		return fmt.Errorf("invalid introspection url: %w", err)
+	}
+
+	if c.ClientID == "" {
+		return fmt.Errorf("introspection client_id is not set")
+	}
+
+	return nil
+}
+
+type TokenValidatorConf struct {
+	Mode          string               `yaml:"mode" enum:"session,jwt,introspection"`
+	JWT           *JWTConfig           `yaml:"jwt"`
+	Introspection *IntrospectionConfig `yaml:"introspection"`
+}
+
+func (c *TokenValidatorConf) Validate() error {
+	if c.JWT != nil {
+		if err := c.JWT.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if c.Introspection != nil {
+		if err := c.Introspection.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return c.CheckMode(c.Mode)
+}
+
+// CheckMode verifies the validator is known and its section is configured
+func (c *TokenValidatorConf) CheckMode(mode string) error {
+	switch mode {
+	case "", ValidatorSession:
+		return nil
+	case ValidatorJWT:
+		if c == nil || c.JWT == nil {
+			return fmt.Errorf("jwt section is required for %s token validator", ValidatorJWT)
+		}
+	case ValidatorIntrospection:
+		if c == nil || c.Introspection == nil {
+			return fmt.Errorf("introspection section is required for %s token validator", ValidatorIntrospection)
+		}
+	default:
+		return fmt.Errorf("unknown token validator mode %s", mode)
+	}
+
+	return nil
+}
+
+// DefaultMode is the validator used by APIs which don't set their own one
+func (c *TokenValidatorConf) DefaultMode() string {
+	if c == nil || c.Mode == "" {
+		return ValidatorSession
+	}
+
+	return c.Mode
+}
+
+type SessionCacheConfig struct {
+	PositiveTTL time.Duration `yaml:"positive_ttl"`
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+	MaxEntries  int           `yaml:"max_entries"`
+}
+
+func (c *SessionCacheConfig) Validate() error {
+	if c.PositiveTTL < 0 || c.NegativeTTL < 0 || c.MaxEntries < 0 {
+		return fmt.Errorf("session cache ttl and size cannot be negative")
+	}
+
+	if c.PositiveTTL == 0 && c.NegativeTTL == 0 {
+		return fmt.Errorf("at least one of positive_ttl or negative_ttl must be set")
+	}
+
+	return nil
+}
+
+type CircuitBreakerConfig struct {
+	// consecutive backend failures which open the breaker
+	FailureThreshold int `yaml:"failure_threshold"`
+	// how long the breaker stays open before probe requests are let through
+	OpenTimeout time.Duration `yaml:"open_timeout"`
+	// number of probe requests in half-open state
+	HalfOpenRequests int `yaml:"half_open_requests"`
+}
+
+func (c *CircuitBreakerConfig) Validate() error {
+	if c.FailureThreshold < 0 || c.OpenTimeout < 0 || c.HalfOpenRequests < 0 {
+		return fmt.Errorf("circuit breaker settings cannot be negative")
+	}
+
+	return nil
+}
+
+type AuthBackendConf struct {
+	// deadline of one ValidateSession call
+	Timeout        time.Duration         `yaml:"timeout"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuit_breaker"`
+}
+
+func (c *AuthBackendConf) Validate() error {
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout cannot be negative")
+	}
+
+	if c.CircuitBreaker != nil {
+		return c.CircuitBreaker.Validate()
+	}
+
+	return nil
+}
+
+func (c *AuthBackendConf) GetTimeout() time.Duration {
+	if c == nil || c.Timeout == 0 {
+		return DefaultAuthBackendTimeout
+	}
+
+	return c.Timeout
+}
+
+type APIKeysConf struct {
+	File           string        `yaml:"file"`
+	Header         string        `yaml:"header"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+func (c *APIKeysConf) Validate() error {
+	if c.File == "" {
+		return fmt.Errorf("api keys file is not set")
+	}
+
+	if c.ReloadInterval < 0 {
+		return fmt.Errorf("reload_interval cannot be negative")
+	}
+
+	return nil
+}
+
+func (c *APIKeysConf) GetHeader() string {
+	if c.Header == "" {
+		return DefaultAPIKeyHeader
+	}
+
+	return strings.ToLower(c.Header)
+}
+
+// PolicyEngineConf enables Rego policies evaluated by the auth-adapter after session validation
+type PolicyEngineConf struct {
+	Bundle         string        `yaml:"bundle"` // directory with .rego and data.json files
+	Query          string        `yaml:"query"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+func (c *PolicyEngineConf) Validate() error {
+	if c.Bundle == "" {
+		return fmt.Errorf("policy bundle directory is not set")
+	}
+
+	if c.ReloadInterval < 0 {
+		return fmt.Errorf("reload_interval cannot be negative")
+	}
+
+	return nil
+}
+
+func (c *PolicyEngineConf) GetQuery() string {
+	if c.Query == "" {
+		return DefaultPolicyQuery
+	}
+
+	return c.Query
+}
+
+// AuditConf enables the audit log of authorization decisions, one JSON record per check
+type AuditConf struct {
+	File       string `yaml:"file"`
+	MaxSize    int    `yaml:"max_size"`    // MB, the file is rotated when it grows larger
+	MaxBackups int    `yaml:"max_backups"` // rotated files kept
+	// share of allowed requests recorded, 1 by default, denied requests are always recorded
+	AllowSampleRate *float64       `yaml:"allow_sample_rate"`
+	OTLP            *AuditOTLPConf `yaml:"otlp"`
+}
+
+// AuditOTLPConf exports audit records with the OTLP logs protocol over gRPC
+type AuditOTLPConf struct {
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"`
+}
+
+func (c *AuditConf) Validate() error {
+	if c.File == "" && c.OTLP == nil {
+		return fmt.Errorf("audit needs file or otlp")
+	}
+
+	if c.MaxSize < 0 || c.MaxBackups < 0 {
+		return fmt.Errorf("max_size and max_backups cannot be negative")
+	}
+
+	if c.AllowSampleRate != nil && (*c.AllowSampleRate < 0 || *c.AllowSampleRate > 1) {
+		return fmt.Errorf("allow_sample_rate must be between 0 and 1")
+	}
+
+	if c.OTLP != nil && c.OTLP.Endpoint == "" {
+		return fmt.Errorf("otlp endpoint is not set")
+	}
+
+	return nil
+}
+
+func (c *AuditConf) GetMaxSize() int {
+	if c.MaxSize == 0 {
+		return DefaultAuditMaxSize
+	}
+
+	return c.MaxSize
+}
+
+func (c *AuditConf) GetMaxBackups() int {
+	if c.MaxBackups == 0 {
+		return DefaultAuditMaxBackups
+	}
+
+	return c.MaxBackups
+}
+
+func (c *AuditConf) GetAllowSampleRate() float64 {
+	if c.AllowSampleRate == nil {
+		return 1
+	}
+
+	return *c.AllowSampleRate
+}
+
+// MTLSIdentityConf maps a client certificate to a service identity,
+// the certificate matches by any of its SANs or by the subject
+type MTLSIdentityConf struct {
+	Service     string   `yaml:"service"`
+	SAN         string   `yaml:"san"`
+	Subject     string   `yaml:"subject"`
+	Permissions []string `yaml:"permissions"`
+}
+
+func (c *MTLSIdentityConf) Validate() error {
+	if c.Service == "" {
+		return fmt.Errorf("service is not set")
+	}
+
+	if (c.SAN == "") == (c.Subject == "") {
+		return fmt.Errorf("exactly one of san or subject must be set for service %s", c.Service)
+	}
+
+	return nil
+}
+
+// Grants are the service permissions, services have no roles
+func (c *MTLSIdentityConf) Grants() Grants {
+	return Grants{Permissions: c.Permissions}
+}
+
+// AuthAdapterConf is the ext_authz gRPC server of the auth-adapter, the gateway renders
+// the ext_auth cluster with the same settings
+type AuthAdapterConf struct {
+	// host:port or unix:/path/to.sock, :9000 by default
+	Listen string `yaml:"listen"`
+	// HTTP authorization endpoint (Envoy http_service, nginx auth_request, Traefik ForwardAuth), off when empty
+	HTTPListen string `yaml:"http_listen"`
+	// ext_authz variant the gateway renders, grpc by default, http requires http_listen
+	Protocol string              `yaml:"protocol" enum:"grpc,http"`
+	TLS      *AuthAdapterTLSConf `yaml:"tls"`
+}
+
+// AuthAdapterTLSConf secures the connection from Envoy to the auth-adapter,
+// with client_ca_file only Envoy's certificate is accepted (mTLS)
+type AuthAdapterTLSConf struct {
+	// the auth-adapter side
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+
+	// the Envoy side: ca_file verifies the auth-adapter certificate, client cert is presented with mTLS
+	CAFile         string `yaml:"ca_file"`
+	ClientCertFile string `yaml:"client_cert_file"`
+	ClientKeyFile  string `yaml:"client_key_file"`
+	// SNI and the verified name of the auth-adapter certificate, the auth-adapter host by default
+	ServerName string `yaml:"server_name"`
+}
+
+func (c *AuthAdapterConf) Validate() error {
+	if err := validateListen(c.GetListen()); err != nil {
+		return err
+	}
+
+	if c.HTTPListen != "" {
+		if err := validateListen(c.HTTPListen); err != nil {
+			return fmt.Errorf("http_listen: %w", err)
+		}
+	}
+
+	switch c.Protocol {
+	case "", ProtocolGRPC:
+	case ProtocolHTTP:
+		if c.HTTPListen == "" {
+			return fmt.Errorf("http protocol requires http_listen")
+		}
+	default:
+		return fmt.Errorf("unknown protocol %s", c.Protocol)
+	}
+
+	if c.TLS != nil {
+		if err := c.TLS.Validate(); err != nil {
+			return fmt.Errorf("invalid tls: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (c *AuthAdapterConf) GetListen() string {
+	if c == nil || c.Listen == "" {
+		return DefaultAuthAdapterListen
+	}
+
+	return c.Listen
+}
+
+func (c *AuthAdapterConf) GetHTTPListen() string {
+	if c == nil {
+		return ""
+	}
+
+	return c.HTTPListen
+}
+
+// HTTP tells whether the gateway calls the HTTP authorization endpoint
+func (c *AuthAdapterConf) HTTP() bool {
+	return c != nil && c.Protocol == ProtocolHTTP
+}
+
+// GatewayListen is the address the gateway calls: http_listen with the http protocol, listen otherwise
+func (c *AuthAdapterConf) GatewayListen() string {
+	if c.HTTP() {
+		return c.HTTPListen
+	}
+
+	return c.GetListen()
+}
+
+func validateListen(listen string) error {
+	if path, ok := ListenSocket(listen); ok {
+		if path == "" {
+			return fmt.Errorf("unix socket path is not set")
+		}
+		return nil
+	}
+
+	_, err := ListenPort(listen)
+
+	return err
+}
+
+// ListenSocket returns the socket path when the listen address is a unix domain socket
+func ListenSocket(listen string) (string, bool) {
+	if !strings.HasPrefix(listen, unixSocketPrefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(listen, unixSocketPrefix), true
+}
+
+// ListenPort returns the TCP port of the listen address
+func ListenPort(listen string) (int, error) {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return 0, fmt.Errorf("invalid listen address: %w", err)
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return 0, fmt.Errorf("invalid listen port %q", port)
+	}
+
+	return p, nil
+}
+
+// GetTLS returns nil for plaintext connections
+func (c *AuthAdapterConf) GetTLS() *AuthAdapterTLSConf {
+	if c == nil {
+		return nil
+	}
+
+	return c.TLS
+}
+
+func (c *AuthAdapterTLSConf) Validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("cert_file and key_file are required")
+	}
+
+	if c.CAFile == "" {
+		return fmt.Errorf("ca_file is required to verify the auth-adapter certificate")
+	}
+
+	if (c.ClientCertFile == "") != (c.ClientKeyFile == "") {
+		return fmt.Errorf("client_cert_file and client_key_file must be set together")
+	}
+
+	if c.ClientCAFile != "" && c.ClientCertFile == "" {
+		return fmt.Errorf("client_ca_file requires client_cert_file and client_key_file for Envoy")
+	}
+
+	return nil
+}
+
+// MTLS tells whether the auth-adapter requires client certificates
+func (c *AuthAdapterTLSConf) MTLS() bool {
+	return c.ClientCAFile != ""
+}
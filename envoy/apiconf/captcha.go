@@ -0,0 +1,179 @@
+package apiconf
+
+import (
+	"fmt"
+	"net/url"
+)
+
+const (
+	// captcha providers
+	CaptchaReCaptcha = "recaptcha"
+	CaptchaHCaptcha  = "hcaptcha"
+	CaptchaTurnstile = "turnstile"
+)
+
+// captchaDefaults are the public siteverify endpoints and the token headers of the providers
+var captchaDefaults = map[string]CaptchaProviderConf{
+	CaptchaReCaptcha: {
+		URL:             "https://www.google.com/recaptcha/api/siteverify",
+		TokenHeader:     "x-rc-token",
+		ChallengeHeader: "x-rc-token-2",
+	},
+	CaptchaHCaptcha: {
+		URL:             "https://api.hcaptcha.com/siteverify",
+		TokenHeader:     "x-hcaptcha-token",
+		ChallengeHeader: "x-hcaptcha-token",
+	},
+	CaptchaTurnstile: {
+		URL:             "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		TokenHeader:     "x-turnstile-token",
+		ChallengeHeader: "x-turnstile-token",
+	},
+}
+
+// CaptchaConf selects the captcha provider of APIs which don't set captcha_provider
+// and overrides endpoints and token headers of the providers, secrets are passed in env
+type CaptchaConf struct {
+	Provider  string               `yaml:"provider" enum:"recaptcha,hcaptcha,turnstile"` // recaptcha by default
+	ReCaptcha *CaptchaProviderConf `yaml:"recaptcha"`
+	HCaptcha  *CaptchaProviderConf `yaml:"hcaptcha"`
+	Turnstile *CaptchaProviderConf `yaml:"turnstile"`
+}
+
+// CaptchaProviderConf is a siteverify endpoint, the token header is checked for rules with
+// need_recaptcha and the challenge header lets users pass rate limits
+type CaptchaProviderConf struct {
+	URL             string `yaml:"url"`
+	TokenHeader     string `yaml:"token_header"`
+	ChallengeHeader string `yaml:"challenge_header"`
+}
+
+func (c *CaptchaConf) Validate() error {
+	if err := checkCaptchaProvider(c.Provider); err != nil {
+		return err
+	}
+
+	for name, p := range map[string]*CaptchaProviderConf{
+		CaptchaReCaptcha: c.ReCaptcha, CaptchaHCaptcha: c.HCaptcha, CaptchaTurnstile: c.Turnstile,
+	} {
+		if p == nil || p.URL == "" {
+			continue
+		}
+		if u, err := url.Parse(p.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("invalid %s url %q", name, p.URL)
+		}
+	}
+
+	return nil
+}
+
+func checkCaptchaProvider(name string) error {
+	switch name {
+	case "", CaptchaReCaptcha, CaptchaHCaptcha, CaptchaTurnstile:
+		return nil
+	default:
+		return fmt.Errorf("unknown captcha provider %s", name)
+	}
+}
+
+// GetProvider returns the default captcha provider
+func (c *CaptchaConf) GetProvider() string {
+	if c == nil || c.Provider == "" {
+		return CaptchaReCaptcha
+	}
+
+	return c.Provider
+}
+
+// ProviderConf returns the provider settings with defaults of the unset fields
+func (c *CaptchaConf) ProviderConf(name string) CaptchaProviderConf {
+	res := captchaDefaults[name]
+	if c == nil {
+		return res
+	}
+
+	var p *CaptchaProviderConf
+	switch name {
+	case CaptchaReCaptcha:
+		p = c.ReCaptcha
+	case CaptchaHCaptcha:
+		p = c.HCaptcha
+	case CaptchaTurnstile:
+		p = c.Turnstile
+	}
+	if p == nil {
+		return res
+	}
+
+	if p.URL != "" {
+		res.URL = p.URL
+	}
+	if p.TokenHeader != "" {
+		res.TokenHeader = p.TokenHeader
+	}
+	if p.ChallengeHeader != "" {
+		res.ChallengeHeader = p.ChallengeHeader
+	}
+
+	return res
+}
+
+// CaptchaProvider returns the provider checking tokens of the rule
+func (c *APIConf) CaptchaProvider(auth *AuthConf) string {
+	if auth != nil && auth.CaptchaProvider != "" {
+		return auth.CaptchaProvider
+	}
+
+	return c.Captcha.GetProvider()
+}
+
+// UsedCaptchaProviders returns the providers checking tokens of need_recaptcha rules and challenges
+// of rate limits, and captcha.provider when it is set
+func (c *APIConf) UsedCaptchaProviders() []string {
+	var res []string
+	seen := map[string]bool{}
+	add := func(provider string) {
+		if !seen[provider] {
+			seen[provider] = true
+			res = append(res, provider)
+		}
+	}
+
+	if c.Captcha != nil && c.Captcha.Provider != "" {
+		add(c.Captcha.Provider)
+	}
+	for _, api := range c.APIsDescr {
+		auths := []*AuthConf{api.Auth}
+		for _, m := range api.Methods {
+			auths = append(auths, m.Auth)
+		}
+		for _, auth := range auths {
+			if auth != nil && (auth.NeedReCaptcha() || auth.RateLimit != nil) {
+				add(c.CaptchaProvider(auth))
+			}
+		}
+	}
+
+	return res
+}
+
+// CaptchaProviders returns the default provider and the providers set by rules
+func (c *APIConf) CaptchaProviders() []string {
+	res := []string{c.Captcha.GetProvider()}
+	seen := map[string]bool{res[0]: true}
+	add := func(auth *AuthConf) {
+		if auth != nil && auth.CaptchaProvider != "" && !seen[auth.CaptchaProvider] {
+			seen[auth.CaptchaProvider] = true
+			res = append(res, auth.CaptchaProvider)
+		}
+	}
+
+	for _, api := range c.APIsDescr {
+		add(api.Auth)
+		for _, m := range api.Methods {
+			add(m.Auth)
+		}
+	}
+
+	return res
+}
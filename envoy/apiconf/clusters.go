@@ -0,0 +1,101 @@
+package apiconf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type HealthCheckConf struct {
+	Path               string `yaml:"path"`                // Health check path
+	IntervalSeconds    int    `yaml:"interval_seconds"`    // Check interval
+	TimeoutSeconds     int    `yaml:"timeout_seconds"`     // Request timeout
+	HealthyThreshold   int    `yaml:"healthy_threshold"`   // Healthy threshold
+	UnhealthyThreshold int    `yaml:"unhealthy_threshold"` // Unhealthy threshold
+}
+
+type CircuitBreakerConf struct {
+	MaxConnections     int `yaml:"max_connections"`      // Max connections
+	MaxPendingRequests int `yaml:"max_pending_requests"` // Max pending requests
+	MaxRequests        int `yaml:"max_requests"`         // Max requests
+	MaxRetries         int `yaml:"max_retries"`          // Max retries
+}
+
+// ClusterConf is an upstream the gateway routes APIs to, it is not used by the auth-adapter
+type ClusterConf struct {
+	Name           string              `yaml:"name"`
+	Addr           string              `yaml:"addr"`
+	Type           string              `yaml:"type" enum:"grpc,http"` // "grpc" or "http"
+	HealthCheck    *HealthCheckConf    `yaml:"health_check"`          // Optional health check
+	CircuitBreaker *CircuitBreakerConf `yaml:"circuit_breaker"`       // Optional circuit breaker
+}
+
+// Validate checks the cluster and fills in defaults of health check and circuit breaker
+func (c ClusterConf) Validate() error {
+	parts := strings.Split(c.Addr, ":")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid address %s", c.Addr)
+	}
+	_, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid port number %s", parts[1])
+	}
+
+	// Validate cluster type
+	if c.Type != "" && c.Type != "grpc" && c.Type != "http" {
+		return fmt.Errorf("invalid cluster type %s, must be 'grpc' or 'http'", c.Type)
+	}
+
+	// Validate health check
+	if c.HealthCheck != nil {
+		if c.HealthCheck.Path == "" {
+			return fmt.Errorf("health check path cannot be empty")
+		}
+		if c.HealthCheck.IntervalSeconds <= 0 {
+			c.HealthCheck.IntervalSeconds = 30 // default
+		}
+		if c.HealthCheck.TimeoutSeconds <= 0 {
+			c.HealthCheck.TimeoutSeconds = 5 // default
+		}
+		if c.HealthCheck.HealthyThreshold <= 0 {
+			c.HealthCheck.HealthyThreshold = 2 // default
+		}
+		if c.HealthCheck.UnhealthyThreshold <= 0 {
+			c.HealthCheck.UnhealthyThreshold = 3 // default
+		}
+	}
+
+	// Validate circuit breaker
+	if c.CircuitBreaker != nil {
+		if c.CircuitBreaker.MaxConnections <= 0 {
+			c.CircuitBreaker.MaxConnections = 1024 // default
+		}
+		if c.CircuitBreaker.MaxPendingRequests <= 0 {
+			c.CircuitBreaker.MaxPendingRequests = 1024 // default
+		}
+		if c.CircuitBreaker.MaxRequests <= 0 {
+			c.CircuitBreaker.MaxRequests = 1024 // default
+		}
+		if c.CircuitBreaker.MaxRetries <= 0 {
+			c.CircuitBreaker.MaxRetries = 3 // default
+		}
+	}
+
+	return nil
+}
+
+func (c ClusterConf) AddrHost() string {
+	return strings.Split(c.Addr, ":")[0]
+}
+
+func (c ClusterConf) AddrPort() string {
+	return strings.Split(c.Addr, ":")[1]
+}
+
+func (c ClusterConf) IsGRPC() bool {
+	return c.Type == "" || c.Type == "grpc" // default to gRPC
+}
+
+func (c ClusterConf) IsHTTP() bool {
+	return c.Type == "http"
+}
@@ -0,0 +1,367 @@
+// Package apiconf is the API config shared by the Envoy config generator and the auth-adapter:
+// the schema, its defaults and validation. A config accepted by the generator is loaded
+// by the adapter as is.
+package apiconf
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SchemaVersion is the latest config version, configs without version are treated as version 1
+const SchemaVersion = 1
+
+type MethodDescr struct {
+	Name string `yaml:"name"`
+	// HTTP APIs only: the verb and the path template relative to the API, e.g. orders/{id}/refund,
+	// by default the method matches any verb and the paths starting with its name
+	Verb string `yaml:"verb" enum:"GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS"`
+	Path string `yaml:"path"`
+	// auth rule for the methods matching the regex, globs in the name (Get*, admin/*) are the other way
+	Regex string    `yaml:"regex"`
+	Auth  *AuthConf `yaml:"auth"`
+}
+
+type APIDescr struct {
+	Name    string        `yaml:"name"`
+	Cluster string        `yaml:"cluster"`
+	Auth    *AuthConf     `yaml:"auth"`
+	Methods []MethodDescr `yaml:"methods"`
+}
+
+type APIConf struct {
+	Version   int           `yaml:"version"`
+	APIsDescr []APIDescr    `yaml:"apis"`
+	Clusters  []ClusterConf `yaml:"clusters"`
+	APIRoute  APIRoutes     `yaml:"api_route"`
+
+	TokenValidator *TokenValidatorConf `yaml:"token_validator"`
+	APIKeys        *APIKeysConf        `yaml:"api_keys"`
+	MTLSIdentities []*MTLSIdentityConf `yaml:"mtls_identities"`
+	SessionCache   *SessionCacheConfig `yaml:"session_cache"`
+	AuthBackend    *AuthBackendConf    `yaml:"auth_backend"`
+	Authorization  *AuthorizationConf  `yaml:"authorization"`
+	PolicyEngine   *PolicyEngineConf   `yaml:"policy_engine"`
+	Audit          *AuditConf          `yaml:"audit"`
+	AuthAdapter    *AuthAdapterConf    `yaml:"auth_adapter"`
+	Captcha        *CaptchaConf        `yaml:"captcha"`
+
+	apiPrefixes  []string
+	methodsIndex map[string]*AuthConf
+	routes       map[string][]*MethodDescr
+	rules        map[string]*methodRules
+}
+
+// Load reads and validates the config file
+func Load(file string) (*APIConf, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+func Parse(data []byte) (*APIConf, error) {
+	c := &APIConf{}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Validate checks the auth rules and the auth-adapter sections, methods inherit token sources,
+// validator and unavailability behaviour of their API
+func (c *APIConf) Validate() error {
+	if c.Version < 0 || c.Version > SchemaVersion {
+		return fmt.Errorf("unsupported config version %d, the latest one is %d", c.Version, SchemaVersion)
+	}
+
+	if err := c.APIRoute.Validate(); err != nil {
+		return err
+	}
+
+	if c.TokenValidator != nil {
+		if err := c.TokenValidator.Validate(); err != nil {
+			return fmt.Errorf("invalid token_validator: %w", err)
+		}
+	}
+
+	mi := make(map[string]*AuthConf)
+	patterns := make(map[string]*AuthConf)
+	routes := make(map[string][]*MethodDescr)
+	rules := make(map[string]*methodRules)
+	apis := make(map[string]bool)
+	for i := range c.APIsDescr {
+		api := &c.APIsDescr[i]
+		if apis[api.Name] {
+			return fmt.Errorf("API %s is defined twice", api.Name)
+		}
+		apis[api.Name] = true
+
+		if api.Auth != nil {
+			if err := c.validateAuth(api.Auth); err != nil {
+				return fmt.Errorf("%w for service %s", err, api.Name)
+			}
+			mi[api.Name] = api.Auth
+		}
+
+		for _, method := range api.Methods {
+			fullPath := fmt.Sprintf("%s/%s", api.Name, method.ruleName())
+			if _, ok := mi[fullPath]; ok {
+				return fmt.Errorf("method %s is already configured", fullPath)
+			}
+			if _, ok := patterns[fullPath]; ok {
+				return fmt.Errorf("method %s is already configured", fullPath)
+			}
+
+			validate := method.Validate
+			if method.IsPattern() {
+				validate = method.validatePattern
+			}
+			if err := validate(); err != nil {
+				return fmt.Errorf("%w for method %s", err, fullPath)
+			}
+
+			if method.Auth != nil {
+				if err := c.validateAuth(method.Auth); err != nil {
+					return fmt.Errorf("%w for method %s", err, fullPath)
+				}
+				method.Auth.inherit(api.Auth)
+				if method.IsPattern() {
+					patterns[fullPath] = method.Auth
+				} else {
+					mi[fullPath] = method.Auth
+				}
+			}
+		}
+		routes[api.Name] = api.RouteMethods()
+
+		apiRules, err := compileRules(api)
+		if err != nil {
+			return fmt.Errorf("%w for service %s", err, api.Name)
+		}
+		if apiRules != nil {
+			rules[api.Name] = apiRules
+		}
+	}
+
+	for _, index := range []map[string]*AuthConf{mi, patterns} {
+		for name, auth := range index {
+			if auth.APIKey() && c.APIKeys == nil {
+				return fmt.Errorf("%s policy is used by %s but api_keys are not configured", PolicyAPIKey, name)
+			}
+			if auth.MTLS() && len(c.MTLSIdentities) == 0 {
+				return fmt.Errorf("%s policy is used by %s but mtls_identities are not configured", PolicyMTLS, name)
+			}
+		}
+	}
+
+	identities := make(map[string]bool)
+	for _, id := range c.MTLSIdentities {
+		if err := id.Validate(); err != nil {
+			return fmt.Errorf("invalid mtls_identities: %w", err)
+		}
+		key := "san:" + id.SAN
+		if id.Subject != "" {
+			key = "subject:" + id.Subject
+		}
+		if identities[key] {
+			return fmt.Errorf("invalid mtls_identities: identity %s is already configured", key)
+		}
+		identities[key] = true
+	}
+
+	if c.AuthBackend != nil {
+		if err := c.AuthBackend.Validate(); err != nil {
+			return fmt.Errorf("invalid auth_backend: %w", err)
+		}
+	}
+
+	if c.SessionCache != nil {
+		if err := c.SessionCache.Validate(); err != nil {
+			return fmt.Errorf("invalid session_cache: %w", err)
+		}
+	}
+
+	if c.APIKeys != nil {
+		if err := c.APIKeys.Validate(); err != nil {
+			return fmt.Errorf("invalid api_keys: %w", err)
+		}
+	}
+
+	if c.PolicyEngine != nil {
+		if err := c.PolicyEngine.Validate(); err != nil {
+			return fmt.Errorf("invalid policy_engine: %w", err)
+		}
+	}
+
+	if c.Audit != nil {
+		if err := c.Audit.Validate(); err != nil {
+			return fmt.Errorf("invalid audit: %w", err)
+		}
+	}
+
+	if c.AuthAdapter != nil {
+		if err := c.AuthAdapter.Validate(); err != nil {
+			return fmt.Errorf("invalid auth_adapter: %w", err)
+		}
+	}
+
+	if c.Captcha != nil {
+		if err := c.Captcha.Validate(); err != nil {
+			return fmt.Errorf("invalid captcha: %w", err)
+		}
+	}
+
+	if c.Authorization != nil {
+		for _, r := range c.Authorization.DefaultRoles {
+			if r == "" {
+				return fmt.Errorf("invalid authorization: empty role in default_roles")
+			}
+		}
+	}
+
+	c.apiPrefixes = c.APIRoute.Prefixes()
+	c.methodsIndex = mi
+	c.routes = routes
+	c.rules = rules
+
+	return nil
+}
+
+func (c *APIConf) validateAuth(auth *AuthConf) error {
+	if err := auth.Validate(); err != nil {
+		return err
+	}
+
+	return c.TokenValidator.CheckMode(auth.Validator)
+}
+
+// ValidateClusters checks the upstream clusters, they are needed by the generator only
+func (c *APIConf) ValidateClusters() error {
+	clusters := make(map[string]bool)
+	httpClusters := make(map[string]bool)
+	for _, cl := range c.Clusters {
+		if clusters[cl.Name] {
+			return fmt.Errorf("cluster %s is defined twice", cl.Name)
+		}
+		clusters[cl.Name] = true
+		httpClusters[cl.Name] = cl.IsHTTP()
+		if err := cl.Validate(); err != nil {
+			return fmt.Errorf("invalid cluster %s definition: %s", cl.Name, err)
+		}
+	}
+
+	for _, api := range c.APIsDescr {
+		if !clusters[api.Cluster] {
+			return fmt.Errorf("cluster %s for API %s is not defined", api.Cluster, api.Name)
+		}
+		if httpClusters[api.Cluster] {
+			continue
+		}
+		for _, m := range api.Methods {
+			if m.Verb != "" || m.Path != "" {
+				return fmt.Errorf("method %s/%s sets verb or path, they are supported by http clusters only",
+					api.Name, m.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// APIPrefixes returns api_route prefixes in matching order
+func (c *APIConf) APIPrefixes() []string {
+	if c.apiPrefixes == nil {
+		return c.APIRoute.Prefixes()
+	}
+
+	return c.apiPrefixes
+}
+
+// Validators returns all token validators used by the APIs
+func (c *APIConf) Validators() []string {
+	modes := map[string]bool{c.TokenValidator.DefaultMode(): true}
+	for _, auth := range c.methodsIndex {
+		if auth.Validator != "" {
+			modes[auth.Validator] = true
+		}
+	}
+	for _, rules := range c.rules {
+		for _, r := range rules.prefixes {
+			if r.auth.Validator != "" {
+				modes[r.auth.Validator] = true
+			}
+		}
+		for _, r := range rules.patterns {
+			if r.auth.Validator != "" {
+				modes[r.auth.Validator] = true
+			}
+		}
+	}
+
+	res := make([]string, 0, len(modes))
+	for m := range modes {
+		res = append(res, m)
+	}
+
+	return res
+}
+
+// GetRequestedPermissions returns the rule of the method by MatchRule precedence,
+// the method path is its name
+func (c *APIConf) GetRequestedPermissions(service, method string) *AuthConf {
+	name := strings.TrimPrefix(method, service+"/")
+	return c.MatchRule(service, name, name).Auth
+}
+
+// TokenHeaders returns custom headers used as token sources, the API key header and
+// captcha token headers, the gateway must pass them to the auth-adapter
+func (c *APIConf) TokenHeaders() []string {
+	seen := make(map[string]bool)
+	var res []string
+
+	add := func(h string) {
+		h = strings.ToLower(h)
+		if h != "" && !seen[h] {
+			seen[h] = true
+			res = append(res, h)
+		}
+	}
+	addAuth := func(auth *AuthConf) {
+		if auth == nil {
+			return
+		}
+		for _, ts := range auth.TokenSources {
+			add(ts.Header)
+		}
+	}
+
+	for _, api := range c.APIsDescr {
+		addAuth(api.Auth)
+		for _, m := range api.Methods {
+			addAuth(m.Auth)
+		}
+	}
+
+	if c.APIKeys != nil {
+		add(c.APIKeys.GetHeader())
+	}
+
+	for _, name := range c.CaptchaProviders() {
+		p := c.Captcha.ProviderConf(name)
+		add(p.TokenHeader)
+		add(p.ChallengeHeader)
+	}
+
+	return res
+}
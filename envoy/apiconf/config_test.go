@@ -0,0 +1,333 @@
+package apiconf
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	c, err := Parse([]byte(`
+api_route: /api/v1
+apis:
+  - name: user
+    cluster: web
+    auth:
+      policy: optional
+      validator: jwt
+      token_sources: [{header: x-token}]
+      on_auth_unavailable: allow_anonymous
+    methods:
+      - name: profile
+        auth: {policy: required, permission: user:read}
+      - name: login
+        auth:
+          policy: no-need
+          need_recaptcha: true
+          rate_limit: {period: 1m, count: 10, delay: 3s}
+      - name: signup
+        auth:
+          policy: no-need
+          need_recaptcha: {min_score: 0.7, action: signup, hostnames: [example.com]}
+token_validator:
+  jwt: {jwks_file: /etc/jwks.json}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.APIPrefixes(); !reflect.DeepEqual(got, []string{"/api/v1/"}) {
+		t.Errorf("APIPrefixes() = %v", got)
+	}
+
+	profile := c.GetRequestedPermissions("user", "user/profile")
+	if profile == nil || !profile.Required() || profile.Permission != "user:read" {
+		t.Fatalf("user/profile rule = %+v", profile)
+	}
+	if profile.Validator != ValidatorJWT || len(profile.TokenSources) != 1 || profile.TokenSources[0].Header != "x-token" {
+		t.Errorf("user/profile doesn't inherit API settings: %+v", profile)
+	}
+	if profile.OnAuthUnavailable != "" {
+		t.Errorf("required user/profile inherits on_auth_unavailable %s", profile.OnAuthUnavailable)
+	}
+
+	login := c.GetRequestedPermissions("user", "user/login")
+	if !login.NeedReCaptcha() || *login.RateLimit != (RateLimitConf{Period: time.Minute, Count: 10, Delay: 3 * time.Second}) {
+		t.Errorf("user/login rule = %+v", login)
+	}
+
+	signup := c.GetRequestedPermissions("user", "user/signup").ReCaptcha
+	if !signup.Enabled || signup.GetMinScore(0.5) != 0.7 || signup.Action != "signup" ||
+		!signup.AllowHostname("Example.com") || signup.AllowHostname("evil.com") {
+		t.Errorf("user/signup recaptcha = %+v", signup)
+	}
+	if login.ReCaptcha.GetMinScore(0.5) != 0.5 || !login.ReCaptcha.AllowHostname("evil.com") {
+		t.Errorf("user/login recaptcha doesn't use defaults: %+v", login.ReCaptcha)
+	}
+
+	if auth := c.GetRequestedPermissions("user", "user/unknown"); auth == nil || !auth.Optional() {
+		t.Errorf("unknown method doesn't fall back to the API rule: %+v", auth)
+	}
+
+	got := c.Validators()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{ValidatorJWT, ValidatorSession}) {
+		t.Errorf("Validators() = %v", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		want string
+	}{
+		{
+			name: "unsupported version",
+			conf: `version: 2`,
+			want: "unsupported config version 2",
+		},
+		{
+			name: "invalid api_route",
+			conf: `api_route: [/api/, api]`,
+			want: `invalid api_route "api"`,
+		},
+		{
+			name: "unknown policy",
+			conf: `apis: [{name: user, auth: {policy: public}}]`,
+			want: "unknown auth policy public for service user",
+		},
+		{
+			name: "duplicated API",
+			conf: `apis: [{name: user}, {name: user}]`,
+			want: "API user is defined twice",
+		},
+		{
+			name: "duplicated method",
+			conf: `apis: [{name: user, methods: [{name: get, auth: {policy: no-need}}, {name: get}]}]`,
+			want: "method user/get is already configured",
+		},
+		{
+			name: "rate limit without period",
+			conf: `apis: [{name: user, methods: [{name: get, auth: {policy: no-need, rate_limit: {count: 1}}}]}]`,
+			want: "rate limit period must be positive for method user/get",
+		},
+		{
+			name: "rate limit period is not a duration",
+			conf: `apis: [{name: user, methods: [{name: get, auth: {policy: no-need, rate_limit: {period: often, count: 1}}}]}]`,
+			want: "cannot unmarshal",
+		},
+		{
+			name: "invalid token source",
+			conf: `apis: [{name: user, auth: {policy: required, token_sources: [{cookie: token, header: x-token}]}}]`,
+			want: "invalid token source",
+		},
+		{
+			name: "validator without section",
+			conf: `apis: [{name: user, auth: {policy: required, validator: introspection}}]`,
+			want: "introspection section is required",
+		},
+		{
+			name: "unknown on_auth_unavailable",
+			conf: `apis: [{name: user, auth: {policy: required, on_auth_unavailable: retry}}]`,
+			want: "unknown on_auth_unavailable retry",
+		},
+		{
+			name: "allow_anonymous with required policy",
+			conf: `apis: [{name: user, auth: {policy: required, on_auth_unavailable: allow_anonymous}}]`,
+			want: "on_auth_unavailable allow_anonymous can't be used with required policy for service user",
+		},
+		{
+			name: "unknown mode",
+			conf: `apis: [{name: user, auth: {policy: required, mode: audit}}]`,
+			want: "unknown mode audit for service user",
+		},
+		{
+			name: "unknown rate limit mode",
+			conf: `apis: [{name: user, methods: [{name: get, auth: {policy: no-need, rate_limit: {period: 1m, count: 1, mode: dry}}}]}]`,
+			want: "unknown mode dry for method user/get",
+		},
+		{
+			name: "api keys are not configured",
+			conf: `apis: [{name: user, auth: {policy: api-key}}]`,
+			want: "api-key policy is used by user but api_keys are not configured",
+		},
+		{
+			name: "unknown verb",
+			conf: `apis: [{name: orders, methods: [{name: get, verb: FETCH}]}]`,
+			want: "unknown verb FETCH for method orders/get",
+		},
+		{
+			name: "parameter is not a whole segment",
+			conf: `apis: [{name: orders, methods: [{name: refund, path: "orders/id-{id}/refund"}]}]`,
+			want: "a parameter must be a whole segment",
+		},
+		{
+			name: "empty path segment",
+			conf: `apis: [{name: orders, methods: [{name: refund, path: "orders//refund"}]}]`,
+			want: `invalid path "orders//refund" for method orders/refund`,
+		},
+		{
+			name: "audit sample rate",
+			conf: `audit: {file: /var/log/audit.log, allow_sample_rate: 10}`,
+			want: "invalid audit: allow_sample_rate must be between 0 and 1",
+		},
+		{
+			name: "recaptcha min score",
+			conf: `apis: [{name: user, auth: {policy: no-need, need_recaptcha: {min_score: 2}}}]`,
+			want: "invalid need_recaptcha: min_score must be between 0 and 1",
+		},
+		{
+			name: "unknown captcha provider of the API",
+			conf: `apis: [{name: user, auth: {policy: no-need, captcha_provider: friendly}}]`,
+			want: "unknown captcha provider friendly",
+		},
+		{
+			name: "unknown default captcha provider",
+			conf: `captcha: {provider: friendly}`,
+			want: "invalid captcha: unknown captcha provider friendly",
+		},
+		{
+			name: "captcha url",
+			conf: `captcha: {hcaptcha: {url: "hcaptcha:8080"}}`,
+			want: "invalid captcha: invalid hcaptcha url",
+		},
+		{
+			name: "auth adapter listen port",
+			conf: `auth_adapter: {listen: "0.0.0.0"}`,
+			want: "invalid auth_adapter: invalid listen address",
+		},
+		{
+			name: "auth adapter http protocol without http listen",
+			conf: `auth_adapter: {protocol: http}`,
+			want: "invalid auth_adapter: http protocol requires http_listen",
+		},
+		{
+			name: "auth adapter mtls without envoy certificate",
+			conf: `auth_adapter: {tls: {cert_file: a.crt, key_file: a.key, ca_file: ca.crt, client_ca_file: ca.crt}}`,
+			want: "invalid auth_adapter: invalid tls: client_ca_file requires client_cert_file",
+		},
+		{
+			name: "duplicated mtls identity",
+			conf: `mtls_identities: [{service: a, san: spiffe://a}, {service: b, san: spiffe://a}]`,
+			want: "identity san:spiffe://a is already configured",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.conf))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCaptcha(t *testing.T) {
+	c, err := Parse([]byte(`
+apis:
+  - name: user
+    auth: {policy: no-need, captcha_provider: turnstile}
+    methods:
+      - name: login
+        auth: {policy: no-need, need_recaptcha: true}
+      - name: signup
+        auth: {policy: no-need, need_recaptcha: true, captcha_provider: hcaptcha}
+  - name: game
+    auth: {policy: no-need, need_recaptcha: true}
+captcha:
+  hcaptcha: {url: "http://hcaptcha:8080/siteverify", token_header: X-Captcha}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct{ service, method, want string }{
+		{"user", "user/login", CaptchaTurnstile},
+		{"user", "user/signup", CaptchaHCaptcha},
+		{"game", "game/play", CaptchaReCaptcha},
+	} {
+		if got := c.CaptchaProvider(c.GetRequestedPermissions(tt.service, tt.method)); got != tt.want {
+			t.Errorf("CaptchaProvider(%s) = %s, want %s", tt.method, got, tt.want)
+		}
+	}
+
+	want := CaptchaProviderConf{URL: "http://hcaptcha:8080/siteverify", TokenHeader: "X-Captcha", ChallengeHeader: "x-hcaptcha-token"}
+	if got := c.Captcha.ProviderConf(CaptchaHCaptcha); got != want {
+		t.Errorf("ProviderConf(hcaptcha) = %+v, want %+v", got, want)
+	}
+
+	got := c.TokenHeaders()
+	sort.Strings(got)
+	if want := []string{"x-captcha", "x-hcaptcha-token", "x-rc-token", "x-rc-token-2", "x-turnstile-token"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("TokenHeaders() = %v, want %v", got, want)
+	}
+}
+
+func TestValidateClusters(t *testing.T) {
+	c, err := Parse([]byte(`
+clusters:
+  - name: web
+    addr: web:9000
+    health_check: {path: /health}
+apis:
+  - name: user
+    cluster: web
+  - name: billing
+    cluster: billing
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.ValidateClusters()
+	if err == nil || err.Error() != "cluster billing for API billing is not defined" {
+		t.Errorf("ValidateClusters() error = %v", err)
+	}
+
+	if c.Clusters[0].HealthCheck.IntervalSeconds != 30 {
+		t.Errorf("health check defaults are not applied: %+v", c.Clusters[0].HealthCheck)
+	}
+}
+
+func TestValidateClustersVerbOfGRPCMethod(t *testing.T) {
+	c, err := Parse([]byte(`
+clusters:
+  - name: grpc
+    addr: grpc:9000
+apis:
+  - name: user
+    cluster: grpc
+    methods:
+      - name: Get
+        verb: GET
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.ValidateClusters()
+	if err == nil || !strings.Contains(err.Error(), "supported by http clusters only") {
+		t.Errorf("ValidateClusters() error = %v", err)
+	}
+}
+
+func TestAPIRoutesPrefixes(t *testing.T) {
+	tests := []struct {
+		routes APIRoutes
+		want   []string
+	}{
+		{nil, []string{"/api/"}},
+		{APIRoutes{"/api"}, []string{"/api/"}},
+		{APIRoutes{"/api/", "/api/v1"}, []string{"/api/v1/", "/api/"}},
+	}
+
+	for _, tt := range tests {
+		if got := tt.routes.Prefixes(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v.Prefixes() = %v, want %v", tt.routes, got, tt.want)
+		}
+	}
+}
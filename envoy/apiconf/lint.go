@@ -0,0 +1,291 @@
+package apiconf
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Issue is a lint finding, Line and Column are 0 when the position is unknown
+type Issue struct {
+	Line     int
+	Column   int
+	Severity string
+	Message  string
+}
+
+func (i Issue) String() string {
+	if i.Line == 0 {
+		return fmt.Sprintf("%s: %s", i.Severity, i.Message)
+	}
+
+	return fmt.Sprintf("%d:%d: %s: %s", i.Line, i.Column, i.Severity, i.Message)
+}
+
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): `)
+
+// Lint checks the config strictly: unknown fields and values of a wrong type are reported
+// with their positions, then the config is validated and checked for likely mistakes
+func Lint(data []byte) []Issue {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return []Issue{yamlIssue(err.Error())}
+	}
+	if len(doc.Content) == 0 {
+		return []Issue{{Severity: SeverityError, Message: "config is empty"}}
+	}
+	root := doc.Content[0]
+
+	var issues []Issue
+	lintNode(root, reflect.TypeOf(APIConf{}), "", &issues)
+	if len(issues) > 0 {
+		return issues
+	}
+
+	c := &APIConf{}
+	if err := root.Decode(c); err != nil {
+		return []Issue{yamlIssue(err.Error())}
+	}
+
+	if err := c.Validate(); err != nil {
+		return []Issue{{Severity: SeverityError, Message: err.Error()}}
+	}
+	if err := c.ValidateClusters(); err != nil {
+		return []Issue{{Severity: SeverityError, Message: err.Error()}}
+	}
+
+	return lintWarnings(c, root)
+}
+
+func yamlIssue(msg string) Issue {
+	issue := Issue{Severity: SeverityError, Message: msg}
+	if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+		fmt.Sscan(m[1], &issue.Line)
+		issue.Message = msg[len(m[0]):]
+	}
+
+	return issue
+}
+
+func nodeIssue(n *yaml.Node, format string, args ...interface{}) Issue {
+	return Issue{Line: n.Line, Column: n.Column, Severity: SeverityError, Message: fmt.Sprintf(format, args...)}
+}
+
+// lintNode checks the node against the config type t, path is the yaml path used in messages
+func lintNode(n *yaml.Node, t reflect.Type, path string, issues *[]Issue) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if n.Tag == "!!null" {
+		return
+	}
+
+	switch {
+	case t == durationType || t == apiRoutesType || t == reCaptchaType && n.Kind != yaml.MappingNode ||
+		t.Kind() != reflect.Struct && t.Kind() != reflect.Slice && t.Kind() != reflect.Map:
+		// leaf values are checked by decoding them alone to get their positions
+		if err := n.Decode(reflect.New(t).Interface()); err != nil {
+			msg := err.Error()
+			if te, ok := err.(*yaml.TypeError); ok && len(te.Errors) > 0 {
+				msg = te.Errors[0]
+			}
+			*issues = append(*issues, nodeIssue(n, "%s: %s", path, yamlLineRe.ReplaceAllString(msg, "")))
+		}
+	case t.Kind() == reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			*issues = append(*issues, nodeIssue(n, "%s: mapping is expected", path))
+			return
+		}
+
+		fields := make(map[string]reflect.StructField)
+		for _, f := range yamlFields(t) {
+			fields[yamlName(f)] = f
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			f, ok := fields[key.Value]
+			if !ok {
+				msg := fmt.Sprintf("unknown field %s", joinPath(path, key.Value))
+				if s := suggest(key.Value, fields); s != "" {
+					msg += fmt.Sprintf(", did you mean %s?", s)
+				}
+				*issues = append(*issues, nodeIssue(key, "%s", msg))
+				continue
+			}
+			lintNode(value, f.Type, joinPath(path, key.Value), issues)
+		}
+	case t.Kind() == reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			*issues = append(*issues, nodeIssue(n, "%s: list is expected", path))
+			return
+		}
+		for i, item := range n.Content {
+			lintNode(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), issues)
+		}
+	case t.Kind() == reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			*issues = append(*issues, nodeIssue(n, "%s: mapping is expected", path))
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			lintNode(n.Content[i+1], t.Elem(), joinPath(path, n.Content[i].Value), issues)
+		}
+	}
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// suggest returns a known field which differs from the key by a typo
+func suggest(key string, fields map[string]reflect.StructField) string {
+	best, bestDist := "", 3
+	for name := range fields {
+		if d := editDistance(key, name); d < bestDist || d == bestDist && name < best {
+			best, bestDist = name, d
+		}
+	}
+
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+
+	return a
+}
+
+// mappingValue returns the value node of the key, nil when there is no such key
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// lintWarnings reports valid settings which are most likely mistakes
+func lintWarnings(c *APIConf, root *yaml.Node) []Issue {
+	var issues []Issue
+	warn := func(n *yaml.Node, format string, args ...interface{}) {
+		issue := Issue{Severity: SeverityWarning, Message: fmt.Sprintf(format, args...)}
+		if n != nil {
+			issue.Line, issue.Column = n.Line, n.Column
+		}
+		issues = append(issues, issue)
+	}
+	checkAuth := func(auth *AuthConf, n *yaml.Node, name string) {
+		if auth.Required() && auth.Permission == "" && auth.Permissions == nil && len(c.DefaultRoles()) == 0 {
+			warn(n, "%s: required policy without permission lets in any authenticated user", name)
+		}
+	}
+
+	usedClusters := make(map[string]bool)
+	apisNode := mappingValue(root, "apis")
+	for i, api := range c.APIsDescr {
+		usedClusters[api.Cluster] = true
+
+		var apiNode, methodsNode *yaml.Node
+		if apisNode != nil && i < len(apisNode.Content) {
+			apiNode = apisNode.Content[i]
+			methodsNode = mappingValue(apiNode, "methods")
+		}
+
+		if api.Auth != nil {
+			authNode := mappingValue(apiNode, "auth")
+			checkAuth(api.Auth, authNode, api.Name)
+			if api.Auth.RateLimit != nil {
+				warn(mappingValue(authNode, "rate_limit"),
+					"%s: rate_limit is applied per method, it is ignored in the API auth", api.Name)
+			}
+		}
+
+		withoutAuth := false
+		for j, m := range api.Methods {
+			if m.Auth == nil {
+				withoutAuth = true
+				continue
+			}
+			var authNode *yaml.Node
+			if methodsNode != nil && j < len(methodsNode.Content) {
+				authNode = mappingValue(methodsNode.Content[j], "auth")
+			}
+			checkAuth(m.Auth, authNode, api.Name+"/"+m.Name)
+		}
+		if api.Auth == nil && (withoutAuth || len(api.Methods) == 0) {
+			warn(apiNode, "%s: API has no auth, the auth-adapter rejects its methods without own auth", api.Name)
+		}
+	}
+
+	clustersNode := mappingValue(root, "clusters")
+	for i, cl := range c.Clusters {
+		if usedClusters[cl.Name] {
+			continue
+		}
+		var n *yaml.Node
+		if clustersNode != nil && i < len(clustersNode.Content) {
+			n = clustersNode.Content[i]
+		}
+		warn(n, "cluster %s is not used by any API", cl.Name)
+	}
+
+	return issues
+}
+
+// HasErrors reports whether there are issues of error severity
+func HasErrors(issues []Issue) bool {
+	for _, i := range issues {
+		if i.Severity == SeverityError {
+			return true
+		}
+	}
+
+	return false
+}
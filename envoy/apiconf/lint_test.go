@@ -0,0 +1,126 @@
+package apiconf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		want []Issue
+	}{
+		{
+			name: "valid",
+			conf: `
+clusters: [{name: web, addr: "web:9000"}]
+apis:
+  - name: user
+    cluster: web
+    auth: {policy: required, permission: user:read}
+`,
+		},
+		{
+			name: "syntax error",
+			conf: "apis:\n  - name: [user\n",
+			want: []Issue{{Line: 1, Severity: SeverityError, Message: "did not find expected ',' or ']'"}},
+		},
+		{
+			name: "unknown fields and wrong types",
+			conf: `
+clusters: [{name: web, addr: "web:9000"}]
+apis:
+  - name: user
+    cluster: web
+    auth:
+      policy: no-need
+      need_recaptha: true
+    methods:
+      - name: login
+        auth: {policy: no-need, rate_limit: {period: often, count: 1}}
+timeout: 1s
+`,
+			want: []Issue{
+				{Line: 8, Column: 7, Severity: SeverityError,
+					Message: "unknown field apis[0].auth.need_recaptha, did you mean need_recaptcha?"},
+				{Line: 11, Column: 54, Severity: SeverityError,
+					Message: "apis[0].methods[0].auth.rate_limit.period: cannot unmarshal !!str `often` into time.Duration"},
+				{Line: 12, Column: 1, Severity: SeverityError, Message: "unknown field timeout"},
+			},
+		},
+		{
+			name: "recaptcha object and flag",
+			conf: `
+clusters: [{name: web, addr: "web:9000"}]
+apis:
+  - name: user
+    cluster: web
+    methods:
+      - name: login
+        auth: {policy: no-need, need_recaptcha: {min_scor: 0.7}}
+      - name: signup
+        auth: {policy: no-need, need_recaptcha: sure}
+`,
+			want: []Issue{
+				{Line: 8, Column: 50, Severity: SeverityError,
+					Message: "unknown field apis[0].methods[0].auth.need_recaptcha.min_scor, did you mean min_score?"},
+				{Line: 10, Column: 49, Severity: SeverityError,
+					Message: "apis[0].methods[1].auth.need_recaptcha: cannot unmarshal !!str `sure` into bool"},
+			},
+		},
+		{
+			name: "validation error",
+			conf: `
+apis:
+  - name: user
+    cluster: web
+    auth: {policy: public}
+`,
+			want: []Issue{{Severity: SeverityError, Message: "unknown auth policy public for service user"}},
+		},
+		{
+			name: "undefined cluster",
+			conf: `apis: [{name: user, cluster: web, auth: {policy: no-need}}]`,
+			want: []Issue{{Severity: SeverityError, Message: "cluster web for API user is not defined"}},
+		},
+		{
+			name: "warnings",
+			conf: `
+clusters:
+  - {name: web, addr: "web:9000"}
+  - {name: old, addr: "old:9000"}
+apis:
+  - name: user
+    cluster: web
+    auth: {policy: optional, rate_limit: {period: 1m, count: 1}}
+    methods:
+      - name: profile
+        auth: {policy: required}
+  - name: billing
+    cluster: web
+    methods:
+      - name: pay
+authorization: {default_roles: []}
+`,
+			want: []Issue{
+				{Line: 8, Column: 42, Severity: SeverityWarning,
+					Message: "user: rate_limit is applied per method, it is ignored in the API auth"},
+				{Line: 11, Column: 15, Severity: SeverityWarning,
+					Message: "user/profile: required policy without permission lets in any authenticated user"},
+				{Line: 12, Column: 5, Severity: SeverityWarning,
+					Message: "billing: API has no auth, the auth-adapter rejects its methods without own auth"},
+				{Line: 4, Column: 5, Severity: SeverityWarning, Message: "cluster old is not used by any API"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Lint([]byte(tt.conf))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lint() =\n%v\nwant\n%v", got, tt.want)
+			}
+		})
+	}
+}
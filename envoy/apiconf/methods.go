@@ -0,0 +1,146 @@
+package apiconf
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Validate checks the verb and the path template of the method
+func (m *MethodDescr) Validate() error {
+	switch m.Verb {
+	case "", "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+	default:
+		return fmt.Errorf("unknown verb %s", m.Verb)
+	}
+
+	if m.Path == "" {
+		return nil
+	}
+
+	for _, seg := range m.pathSegments() {
+		if seg == "" || strings.ContainsAny(seg, "?#") {
+			return fmt.Errorf("invalid path %q", m.Path)
+		}
+		if strings.ContainsAny(seg, "{}") && !isPathParam(seg) {
+			return fmt.Errorf("invalid path %q, a parameter must be a whole segment like {id}", m.Path)
+		}
+	}
+
+	return nil
+}
+
+// pathSegments returns segments of the path template, nil for methods matched by name
+func (m *MethodDescr) pathSegments() []string {
+	if m.Path == "" {
+		return nil
+	}
+
+	return strings.Split(strings.TrimPrefix(m.Path, "/"), "/")
+}
+
+func isPathParam(seg string) bool {
+	return len(seg) > 2 && seg[0] == '{' && seg[len(seg)-1] == '}' && !strings.ContainsAny(seg[1:len(seg)-1], "{}")
+}
+
+// Match tells whether the request is routed to the method, the path is relative to the API
+// and has no query string. Methods without path template match the paths starting with their name.
+func (m *MethodDescr) Match(verb, path string) bool {
+	if m.Verb != "" && !strings.EqualFold(m.Verb, verb) {
+		return false
+	}
+
+	tmpl := m.pathSegments()
+	if tmpl == nil {
+		return path == m.Name || strings.HasPrefix(path, m.Name+"/")
+	}
+
+	segs := strings.Split(path, "/")
+	if len(segs) != len(tmpl) {
+		return false
+	}
+	for i, seg := range tmpl {
+		if isPathParam(seg) {
+			if segs[i] == "" {
+				return false
+			}
+		} else if seg != segs[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// PathRegex returns the regular expression of the path template, a parameter matches one segment
+func (m *MethodDescr) PathRegex() string {
+	tmpl := m.pathSegments()
+	parts := make([]string, 0, len(tmpl))
+	for _, seg := range tmpl {
+		if isPathParam(seg) {
+			parts = append(parts, "[^/]+")
+		} else {
+			parts = append(parts, regexp.QuoteMeta(seg))
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// routeRank orders method routes: path templates go before methods matched by name, the ones
+// with more literal segments first, and methods of a verb go before the ones of any verb
+func (m *MethodDescr) routeRank() int {
+	rank := 0
+	if tmpl := m.pathSegments(); tmpl != nil {
+		rank = 2
+		for _, seg := range tmpl {
+			if !isPathParam(seg) {
+				rank += 2
+			}
+		}
+	}
+	if m.Verb != "" {
+		rank++
+	}
+
+	return rank
+}
+
+// RouteMethods returns the API methods in the order the gateway matches their routes,
+// methods of the same rank keep the config order, pattern rules have no routes
+func (a *APIDescr) RouteMethods() []*MethodDescr {
+	res := make([]*MethodDescr, 0, len(a.Methods))
+	for i := range a.Methods {
+		if !a.Methods[i].IsPattern() {
+			res = append(res, &a.Methods[i])
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].routeRank() > res[j].routeRank()
+	})
+
+	return res
+}
+
+// MatchMethod returns the method the request to the API is routed to, nil when it goes
+// to the API catch-all route. The path is relative to the API.
+func (c *APIConf) MatchMethod(service, verb, path string) *MethodDescr {
+	routes, ok := c.routes[service]
+	if !ok {
+		for i := range c.APIsDescr {
+			if c.APIsDescr[i].Name == service {
+				routes = c.APIsDescr[i].RouteMethods()
+				break
+			}
+		}
+	}
+
+	for _, m := range routes {
+		if m.Match(verb, path) {
+			return m
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package apiconf
+
+import "testing"
+
+func TestMatchMethod(t *testing.T) {
+	c, err := Parse([]byte(`
+apis:
+  - name: orders
+    methods:
+      - name: list
+      - name: create
+        verb: POST
+        path: orders
+      - name: get
+        verb: GET
+        path: orders/{id}
+      - name: refund
+        verb: POST
+        path: orders/{id}/refund
+      - name: search
+        verb: GET
+        path: orders/search
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		verb string
+		path string
+		want string
+	}{
+		{"GET", "list", "list"},
+		{"DELETE", "list/old", "list"},
+		{"GET", "listing", ""},
+		{"POST", "orders", "create"},
+		{"GET", "orders", ""},
+		{"GET", "orders/42", "get"},
+		{"GET", "orders/search", "search"},
+		{"POST", "orders/42/refund", "refund"},
+		{"GET", "orders/42/refund", ""},
+		{"POST", "orders//refund", ""},
+		{"POST", "orders/42/refund/extra", ""},
+	}
+
+	for _, tt := range tests {
+		got := ""
+		if m := c.MatchMethod("orders", tt.verb, tt.path); m != nil {
+			got = m.Name
+		}
+		if got != tt.want {
+			t.Errorf("MatchMethod(%s %s) = %q, want %q", tt.verb, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestPathRegex(t *testing.T) {
+	m := MethodDescr{Name: "refund", Path: "/orders/{id}/refund.v1"}
+	if got, want := m.PathRegex(), `orders/[^/]+/refund\.v1`; got != want {
+		t.Errorf("PathRegex() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,134 @@
+package apiconf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultRoles are accepted by required rules without permissions when authorization is not configured
+var DefaultRoles = []string{"CLIENT"}
+
+type AuthorizationConf struct {
+	// roles accepted by required rules which set neither permission nor permissions,
+	// an empty list accepts any authenticated user
+	DefaultRoles []string `yaml:"default_roles"`
+}
+
+// PermissionExpr is a permission requirement, all of its set conditions must hold.
+// A permission ending with * matches granted permissions with that prefix, e.g. user:*
+type PermissionExpr struct {
+	AnyOf []string `yaml:"any_of" json:"any_of,omitempty"` // one of the permissions
+	AllOf []string `yaml:"all_of" json:"all_of,omitempty"` // every permission
+	Roles []string `yaml:"roles" json:"roles,omitempty"`   // one of the roles
+}
+
+func (e *PermissionExpr) Validate() error {
+	if len(e.AnyOf) == 0 && len(e.AllOf) == 0 && len(e.Roles) == 0 {
+		return fmt.Errorf("permissions must set any_of, all_of or roles")
+	}
+
+	for _, list := range [][]string{e.AnyOf, e.AllOf} {
+		for _, p := range list {
+			if err := validatePermission(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, r := range e.Roles {
+		if r == "" {
+			return fmt.Errorf("empty role in permissions")
+		}
+	}
+
+	return nil
+}
+
+func validatePermission(p string) error {
+	if p == "" {
+		return fmt.Errorf("empty permission")
+	}
+	if strings.Contains(strings.TrimSuffix(p, "*"), "*") {
+		return fmt.Errorf("invalid permission %s, * can be used at the end only", p)
+	}
+
+	return nil
+}
+
+// Grants are roles and permissions of a caller, permissions of all roles are merged
+type Grants struct {
+	Roles       []string
+	Permissions []string
+}
+
+// HasPermission tells whether the required permission, maybe a wildcard, is granted
+func (g Grants) HasPermission(required string) bool {
+	wildcard := strings.HasSuffix(required, "*")
+	prefix := strings.TrimSuffix(required, "*")
+	for _, p := range g.Permissions {
+		if p == required || wildcard && strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasRole tells whether one of the roles is granted
+func (g Grants) HasRole(roles []string) bool {
+	for _, r := range g.Roles {
+		for _, want := range roles {
+			if r == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (e *PermissionExpr) Allows(g Grants) bool {
+	if len(e.Roles) > 0 && !g.HasRole(e.Roles) {
+		return false
+	}
+
+	for _, p := range e.AllOf {
+		if !g.HasPermission(p) {
+			return false
+		}
+	}
+
+	if len(e.AnyOf) == 0 {
+		return true
+	}
+	for _, p := range e.AnyOf {
+		if g.HasPermission(p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Allows checks permission and permissions of the rule, when the rule sets neither the caller
+// must have one of defaultRoles (any caller is allowed when they are empty)
+func (c *AuthConf) Allows(g Grants, defaultRoles []string) bool {
+	if c.Permission == "" && c.Permissions == nil {
+		return len(defaultRoles) == 0 || g.HasRole(defaultRoles)
+	}
+
+	if c.Permission != "" && !g.HasPermission(c.Permission) {
+		return false
+	}
+
+	return c.Permissions == nil || c.Permissions.Allows(g)
+}
+
+// DefaultRoles returns roles accepted by required rules without permissions
+func (c *APIConf) DefaultRoles() []string {
+	if c.Authorization == nil {
+		return DefaultRoles
+	}
+
+	return c.Authorization.DefaultRoles
+}
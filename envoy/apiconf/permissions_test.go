@@ -0,0 +1,62 @@
+package apiconf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthConfAllows(t *testing.T) {
+	user := Grants{Roles: []string{"CLIENT"}, Permissions: []string{"user:read", "user:write", "billing:read"}}
+	admin := Grants{Roles: []string{"ADMIN"}, Permissions: []string{"admin"}}
+
+	tests := []struct {
+		name  string
+		auth  AuthConf
+		roles []string
+		g     Grants
+		want  bool
+	}{
+		{"default role", AuthConf{}, DefaultRoles, user, true},
+		{"not a default role", AuthConf{}, DefaultRoles, admin, false},
+		{"no default roles", AuthConf{}, nil, admin, true},
+		{"permission", AuthConf{Permission: "user:read"}, DefaultRoles, user, true},
+		{"missing permission", AuthConf{Permission: "user:delete"}, DefaultRoles, user, false},
+		{"wildcard", AuthConf{Permission: "user:*"}, nil, user, true},
+		{"wildcard of another scope", AuthConf{Permission: "admin:*"}, nil, user, false},
+		{"any of", AuthConf{Permissions: &PermissionExpr{AnyOf: []string{"admin", "billing:read"}}}, nil, user, true},
+		{"none of any of", AuthConf{Permissions: &PermissionExpr{AnyOf: []string{"admin", "billing:write"}}}, nil, user, false},
+		{"all of", AuthConf{Permissions: &PermissionExpr{AllOf: []string{"user:read", "billing:*"}}}, nil, user, true},
+		{"not all of", AuthConf{Permissions: &PermissionExpr{AllOf: []string{"user:read", "admin"}}}, nil, user, false},
+		{"role", AuthConf{Permissions: &PermissionExpr{Roles: []string{"ADMIN", "SUPPORT"}}}, nil, admin, true},
+		{"missing role", AuthConf{Permissions: &PermissionExpr{Roles: []string{"ADMIN"}}}, nil, user, false},
+		{"permission and role", AuthConf{Permission: "user:read",
+			Permissions: &PermissionExpr{Roles: []string{"ADMIN"}}}, nil, user, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.auth.Allows(tt.g, tt.roles); got != tt.want {
+				t.Errorf("Allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionErrors(t *testing.T) {
+	tests := []struct {
+		auth string
+		want string
+	}{
+		{`{policy: required, permission: "user:*:read"}`, "* can be used at the end only"},
+		{`{policy: required, permissions: {}}`, "permissions must set any_of, all_of or roles"},
+		{`{policy: required, permissions: {any_of: [""]}}`, "empty permission"},
+		{`{policy: required, permissions: {roles: [""]}}`, "empty role"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse([]byte(`apis: [{name: user, auth: ` + tt.auth + `}]`))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%s) error = %v, want %q", tt.auth, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package apiconf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultAPIRoutes are used when api_route is not set
+var DefaultAPIRoutes = []string{"/api/"}
+
+// APIRoutes is the api_route value, a single prefix or a list of them
+type APIRoutes []string
+
+func (r *APIRoutes) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*r = APIRoutes{value.Value}
+		return nil
+	}
+
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*r = list
+
+	return nil
+}
+
+// Prefixes returns prefixes with the trailing slash, the longest ones go first
+// so that /api/v1/ is matched before /api/
+func (r APIRoutes) Prefixes() []string {
+	if len(r) == 0 {
+		return DefaultAPIRoutes
+	}
+
+	res := make([]string, 0, len(r))
+	for _, p := range r {
+		if !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+		res = append(res, p)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return len(res[i]) > len(res[j])
+	})
+
+	return res
+}
+
+func (r APIRoutes) Validate() error {
+	for _, p := range r {
+		if len(p) == 0 || p[0] != '/' {
+			return fmt.Errorf("invalid api_route %q", p)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package apiconf
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// kinds of matched rules in precedence order
+	RuleExact   = "exact"
+	RulePrefix  = "prefix"
+	RulePattern = "pattern"
+	RuleService = "service"
+)
+
+// RuleMatch tells which rule applies to a request, Auth is nil when there is no rule
+type RuleMatch struct {
+	Kind string
+	Rule string // method name, glob or regex of the rule
+	Auth *AuthConf
+}
+
+type prefixRule struct {
+	name   string
+	prefix string
+	auth   *AuthConf
+}
+
+type patternRule struct {
+	name string
+	re   *regexp.Regexp
+	auth *AuthConf
+}
+
+// methodRules are the compiled pattern rules of an API
+type methodRules struct {
+	prefixes []prefixRule  // the longest prefix first
+	patterns []patternRule // in config order
+}
+
+// IsPattern tells whether the method is a rule for a group of methods: a glob name or a regex.
+// The trailing * of a glob matches the rest of the path, other * and ? don't match /.
+// Such methods have no gateway routes.
+func (m *MethodDescr) IsPattern() bool {
+	return m.Regex != "" || strings.ContainsAny(m.Name, "*?")
+}
+
+// ruleName is the name of the method in messages, the regex for regex rules
+func (m *MethodDescr) ruleName() string {
+	if m.Name == "" {
+		return m.Regex
+	}
+
+	return m.Name
+}
+
+func (m *MethodDescr) validatePattern() error {
+	if m.Name != "" && m.Regex != "" {
+		return fmt.Errorf("either glob name or regex can be set")
+	}
+	if m.Verb != "" || m.Path != "" {
+		return fmt.Errorf("verb and path can't be used with patterns")
+	}
+	if m.Auth == nil {
+		return fmt.Errorf("pattern without auth")
+	}
+	if m.Auth.RateLimit != nil {
+		return fmt.Errorf("rate_limit is applied per method, it can't be used with patterns")
+	}
+
+	_, err := m.patternRegexp()
+	return err
+}
+
+// globPrefix returns the prefix of globs with the only trailing *, e.g. admin/*
+func (m *MethodDescr) globPrefix() (string, bool) {
+	if m.Regex != "" || !strings.HasSuffix(m.Name, "*") {
+		return "", false
+	}
+
+	prefix := strings.TrimSuffix(m.Name, "*")
+	return prefix, !strings.ContainsAny(prefix, "*?")
+}
+
+// patternRegexp compiles the glob or the regex, both match the whole path relative to the API
+func (m *MethodDescr) patternRegexp() (*regexp.Regexp, error) {
+	if m.Regex != "" {
+		re, err := regexp.Compile("^(?:" + m.Regex + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %w", err)
+		}
+		return re, nil
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range m.Name {
+		switch r {
+		case '*':
+			b.WriteString("[^/]*")
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+
+	return regexp.Compile(b.String())
+}
+
+// compileRules builds the matcher of API pattern rules, nil when the API has none
+func compileRules(api *APIDescr) (*methodRules, error) {
+	var rules methodRules
+	for i := range api.Methods {
+		m := &api.Methods[i]
+		if !m.IsPattern() {
+			continue
+		}
+
+		if prefix, ok := m.globPrefix(); ok {
+			rules.prefixes = append(rules.prefixes, prefixRule{name: m.Name, prefix: prefix, auth: m.Auth})
+			continue
+		}
+
+		re, err := m.patternRegexp()
+		if err != nil {
+			return nil, err
+		}
+		rules.patterns = append(rules.patterns, patternRule{name: m.ruleName(), re: re, auth: m.Auth})
+	}
+
+	if len(rules.prefixes) == 0 && len(rules.patterns) == 0 {
+		return nil, nil
+	}
+
+	sort.SliceStable(rules.prefixes, func(i, j int) bool {
+		return len(rules.prefixes[i].prefix) > len(rules.prefixes[j].prefix)
+	})
+
+	return &rules, nil
+}
+
+// MatchRule returns the rule of the request: the own rule of the method, the longest prefix rule,
+// the first matching pattern rule or the API rule. The method is the configured method the request
+// is routed to (empty for the API catch-all route), the path is relative to the API.
+func (c *APIConf) MatchRule(service, method, path string) RuleMatch {
+	if method != "" {
+		if auth, ok := c.methodsIndex[service+"/"+method]; ok {
+			return RuleMatch{Kind: RuleExact, Rule: method, Auth: auth}
+		}
+	}
+
+	if rules := c.rules[service]; rules != nil {
+		for _, r := range rules.prefixes {
+			if strings.HasPrefix(path, r.prefix) {
+				return RuleMatch{Kind: RulePrefix, Rule: r.name, Auth: r.auth}
+			}
+		}
+		for _, r := range rules.patterns {
+			if r.re.MatchString(path) {
+				return RuleMatch{Kind: RulePattern, Rule: r.name, Auth: r.auth}
+			}
+		}
+	}
+
+	if auth, ok := c.methodsIndex[service]; ok {
+		return RuleMatch{Kind: RuleService, Rule: service, Auth: auth}
+	}
+
+	return RuleMatch{}
+}
+
+// RouteRule returns the rule the gateway applies to the route of the method (empty method for the API
+// catch-all route), nil when there is no rule or it depends on the path and the auth-adapter resolves it
+func (c *APIConf) RouteRule(service, method string) *AuthConf {
+	if method != "" {
+		if auth, ok := c.methodsIndex[service+"/"+method]; ok {
+			return auth
+		}
+	}
+
+	if c.rules[service] != nil {
+		return nil
+	}
+
+	return c.methodsIndex[service]
+}
@@ -0,0 +1,90 @@
+package apiconf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchRule(t *testing.T) {
+	c, err := Parse([]byte(`
+apis:
+  - name: user
+    auth: {policy: required}
+    methods:
+      - name: GetProfile
+        auth: {policy: required, permission: "user:profile"}
+      - name: Get*
+        auth: {policy: optional}
+      - name: GetAdmin*
+        auth: {policy: required, permission: admin}
+      - name: "*Status"
+        auth: {policy: no-need}
+      - regex: "(List|Search)[A-Z].*"
+        auth: {policy: optional, permission: "user:list"}
+      - name: admin/*
+        auth: {policy: required, permission: admin}
+  - name: billing
+    methods:
+      - name: Get*
+        auth: {policy: no-need}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		service  string
+		method   string
+		path     string
+		wantKind string
+		wantRule string
+	}{
+		{"user", "GetProfile", "GetProfile", RuleExact, "GetProfile"},
+		{"user", "", "GetSettings", RulePrefix, "Get*"},
+		{"user", "", "GetAdminUsers", RulePrefix, "GetAdmin*"},
+		{"user", "", "GetStatus", RulePrefix, "Get*"},
+		{"user", "", "ServerStatus", RulePattern, "*Status"},
+		{"user", "", "ListUsers", RulePattern, "(List|Search)[A-Z].*"},
+		{"user", "", "Listing", RuleService, "user"},
+		{"user", "", "admin/users/1", RulePrefix, "admin/*"},
+		{"user", "", "users/GetStatus", RuleService, "user"},
+		{"user", "Update", "Update", RuleService, "user"},
+		{"billing", "", "GetInvoice", RulePrefix, "Get*"},
+		{"billing", "", "Pay", "", ""},
+	}
+
+	for _, tt := range tests {
+		got := c.MatchRule(tt.service, tt.method, tt.path)
+		if got.Kind != tt.wantKind || got.Rule != tt.wantRule {
+			t.Errorf("MatchRule(%s, %q, %s) = %s %q, want %s %q",
+				tt.service, tt.method, tt.path, got.Kind, got.Rule, tt.wantKind, tt.wantRule)
+		}
+	}
+
+	if auth := c.GetRequestedPermissions("user", "user/GetThing"); auth == nil || !auth.Optional() {
+		t.Errorf("GetRequestedPermissions(user/GetThing) = %+v, want the Get* rule", auth)
+	}
+	if auth := c.RouteRule("user", ""); auth != nil {
+		t.Errorf("RouteRule of the catch-all route with patterns = %+v, want nil", auth)
+	}
+}
+
+func TestPatternRuleErrors(t *testing.T) {
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{`{name: "Get*", verb: GET, auth: {policy: no-need}}`, "verb and path can't be used with patterns"},
+		{`{name: "Get*"}`, "pattern without auth"},
+		{`{regex: "Get(", auth: {policy: no-need}}`, "invalid regex"},
+		{`{name: "Get*", regex: "Get.*", auth: {policy: no-need}}`, "either glob name or regex"},
+		{`{name: "Get*", auth: {policy: no-need, rate_limit: {period: 1m, count: 1}}}`, "can't be used with patterns"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse([]byte(`apis: [{name: user, methods: [` + tt.method + `]}]`))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%s) error = %v, want %q", tt.method, err, tt.want)
+		}
+	}
+}
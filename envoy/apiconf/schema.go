@@ -0,0 +1,122 @@
+package apiconf
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// durationPattern matches Go durations, e.g. 1m, 1h30m, 500ms
+const durationPattern = `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`
+
+var (
+	durationType  = reflect.TypeOf(time.Duration(0))
+	apiRoutesType = reflect.TypeOf(APIRoutes{})
+	reCaptchaType = reflect.TypeOf(ReCaptchaConf{})
+)
+
+//go:generate sh -c "cd ../api-gateway && go run . schema > ../apiconf/config.schema.json"
+
+// Schema returns JSON Schema (draft-07) of config.yaml generated from the config types,
+// editors use it for completion and validation
+func Schema() ([]byte, error) {
+	g := &schemaGen{defs: make(map[string]interface{})}
+	root := g.structSchema(reflect.TypeOf(APIConf{}))
+	root["$schema"] = "http://json-schema.org/draft-07/schema#"
+	root["title"] = "API gateway and auth-adapter config"
+	root["definitions"] = g.defs
+
+	data, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(data, '\n'), nil
+}
+
+type schemaGen struct {
+	defs map[string]interface{}
+}
+
+func (g *schemaGen) typeSchema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case durationType:
+		return map[string]interface{}{"type": "string", "pattern": durationPattern}
+	case apiRoutesType:
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "string", "pattern": "^/"},
+			map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string", "pattern": "^/"}},
+		}}
+	case reCaptchaType:
+		g.defs[t.Name()] = g.structSchema(t)
+		return map[string]interface{}{"oneOf": []interface{}{
+			map[string]interface{}{"type": "boolean"},
+			map[string]interface{}{"$ref": "#/definitions/" + t.Name()},
+		}}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.typeSchema(t.Elem())
+	case reflect.Struct:
+		if _, ok := g.defs[t.Name()]; !ok {
+			// reserve the name first, the type may refer to itself
+			g.defs[t.Name()] = nil
+			g.defs[t.Name()] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": g.typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.typeSchema(t.Elem())}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	default:
+		return map[string]interface{}{"type": "string"}
+	}
+}
+
+func (g *schemaGen) structSchema(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	for _, f := range yamlFields(t) {
+		s := g.typeSchema(f.Type)
+		if enum := f.Tag.Get("enum"); enum != "" {
+			s["enum"] = strings.Split(enum, ",")
+		}
+		props[yamlName(f)] = s
+	}
+
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+// yamlFields returns exported fields which are read from the config
+func yamlFields(t reflect.Type) []reflect.StructField {
+	var res []reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || yamlName(f) == "-" {
+			continue
+		}
+		res = append(res, f)
+	}
+
+	return res
+}
+
+func yamlName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+	if name == "" {
+		return strings.ToLower(f.Name)
+	}
+
+	return name
+}
@@ -0,0 +1,57 @@
+package apiconf
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestSchemaIsUpToDate(t *testing.T) {
+	schema, err := Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	committed, err := os.ReadFile("config.schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(schema, committed) {
+		t.Errorf("config.schema.json is outdated, run go generate in envoy/apiconf")
+	}
+}
+
+func TestSchema(t *testing.T) {
+	data, err := Schema()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var schema struct {
+		Properties  map[string]json.RawMessage `json:"properties"`
+		Definitions map[string]struct {
+			Properties map[string]struct {
+				Enum []string `json:"enum"`
+			} `json:"properties"`
+		} `json:"definitions"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"api_route", "apis", "clusters", "token_validator", "session_cache"} {
+		if _, ok := schema.Properties[key]; !ok {
+			t.Errorf("schema has no %s property", key)
+		}
+	}
+
+	policy := schema.Definitions["AuthConf"].Properties["policy"].Enum
+	if len(policy) != 5 || policy[0] != PolicyRequired {
+		t.Errorf("auth policy enum = %v", policy)
+	}
+	if _, ok := schema.Definitions["AuthConf"].Properties["need_recaptcha"]; !ok {
+		t.Errorf("need_recaptcha is not in the schema")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"envoy.apiconf"
+	"github.com/tel-io/tel/v2"
+)
+
+// adminHandler serves operational endpoints of the adapter, it must not be exposed publicly
+func (s *server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions/revoke", s.handleRevoke)
+	mux.HandleFunc("/debug/explain", s.handleExplain)
+	mux.HandleFunc("/ready", s.handleReady)
+
+	return mux
+}
+
+// handleRevoke is the revocation hook of the session cache:
+// POST /sessions/revoke with "token" or "session_id" form value
+func (s *server) handleRevoke(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, sessionID := r.PostFormValue("token"), r.PostFormValue("session_id")
+	switch {
+	case token != "":
+		s.RevokeToken(token)
+		s.logger.Info("token is revoked from session cache")
+		w.WriteHeader(http.StatusNoContent)
+	case sessionID != "":
+		evicted := s.RevokeSession(sessionID)
+		s.logger.Info("session is revoked from session cache",
+			tel.String("session", sessionID), tel.Int("evicted", evicted))
+		fmt.Fprintf(w, "%d\n", evicted)
+	default:
+		http.Error(w, "token or session_id is required", http.StatusBadRequest)
+	}
+}
+
+// explainResponse tells which auth rule the adapter applies to a request
+type explainResponse struct {
+	Service    string `json:"service"`
+	Method     string `json:"method"`
+	RuleKind   string `json:"rule_kind,omitempty"`
+	Rule       string `json:"rule,omitempty"`
+	Policy     string `json:"policy,omitempty"`
+	Permission string `json:"permission,omitempty"`
+	Mode       string `json:"mode,omitempty"`
+
+	Permissions *apiconf.PermissionExpr `json:"permissions,omitempty"`
+}
+
+// handleExplain shows the rule matched for a request the way the gateway routes it:
+// GET /debug/explain?path=/api/user/GetProfile[&verb=GET], the verb is POST by default
+func (s *server) handleExplain(w http.ResponseWriter, r *http.Request) {
+	path, verb := r.URL.Query().Get("path"), r.URL.Query().Get("verb")
+	if path == "" {
+		http.Error(w, "path is required", http.StatusBadRequest)
+		return
+	}
+	if verb == "" {
+		verb = http.MethodPost
+	}
+
+	service, method, match := routeTarget(s.config().APIConf, verb, path, nil)
+	if service == "" {
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+
+	resp := explainResponse{Service: service, Method: method, RuleKind: match.Kind, Rule: match.Rule}
+	if match.Auth != nil {
+		resp.Policy, resp.Permission = match.Auth.Policy, match.Auth.Permission
+		resp.Permissions, resp.Mode = match.Auth.Permissions, match.Auth.Mode
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
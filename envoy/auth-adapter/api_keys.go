@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"envoy.apiconf"
+	"github.com/tel-io/tel/v2"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultAPIKeyReloadInterval = 30 * time.Second
+
+// apiKeyClient is a machine client identified by an API key
+type apiKeyClient struct {
+	ClientID    string   `yaml:"client_id"`
+	Hash        string   `yaml:"hash"` // hex encoded sha256 of the key
+	Permissions []string `yaml:"permissions"`
+	Tier        string   `yaml:"tier"`
+
+	rateLimit *apiconf.RateLimitConf
+}
+
+// Grants are the client permissions, clients have no roles
+func (c *apiKeyClient) Grants() apiconf.Grants {
+	return apiconf.Grants{Permissions: c.Permissions}
+}
+
+type apiKeysFile struct {
+	Tiers map[string]*apiconf.RateLimitConf `yaml:"tiers"`
+	Keys  []*apiKeyClient                   `yaml:"keys"`
+}
+
+// APIKeyStore keeps hashed API keys loaded from a file, the file is re-read when it is changed
+type APIKeyStore struct {
+	conf   *apiconf.APIKeysConf
+	logger *tel.Telemetry
+
+	mx   sync.RWMutex
+	keys map[string]*apiKeyClient
+
+	done chan struct{}
+}
+
+func NewAPIKeyStore(conf *apiconf.APIKeysConf, logger *tel.Telemetry) (*APIKeyStore, error) {
+	s := &APIKeyStore{
+		conf:   conf,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	interval := conf.ReloadInterval
+	if interval == 0 {
+		interval = defaultAPIKeyReloadInterval
+	}
+	go watchFile(conf.File, interval, s.done, logger, func() {
+		// keep serving the previous keys if the new file is broken
+		if err := s.load(); err != nil {
+			logger.Error("api keys reload failed", tel.String("file", conf.File), tel.Error(err))
+		}
+	})
+
+	return s, nil
+}
+
+func (s *APIKeyStore) Lookup(key string) (*apiKeyClient, bool) {
+	sum := sha256.Sum256([]byte(key))
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	c, ok := s.keys[hex.EncodeToString(sum[:])]
+
+	return c, ok
+}
+
+func (s *APIKeyStore) Close() {
+	close(s.done)
+}
+
+func (s *APIKeyStore) load() error {
+	data, err := os.ReadFile(s.conf.File)
+	if err != nil {
+		return err
+	}
+
+	f := &apiKeysFile{}
+	if err := yaml.Unmarshal(data, f); err != nil {
+		return err
+	}
+
+	keys := make(map[string]*apiKeyClient, len(f.Keys))
+	for _, k := range f.Keys {
+		if k.ClientID == "" {
+			return fmt.Errorf("api key without client_id")
+		}
+
+		hash := strings.ToLower(k.Hash)
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("invalid sha256 hash for client %s", k.ClientID)
+		}
+		if _, ok := keys[hash]; ok {
+			return fmt.Errorf("duplicated api key for client %s", k.ClientID)
+		}
+
+		if k.Tier != "" {
+			tier, ok := f.Tiers[k.Tier]
+			if !ok {
+				return fmt.Errorf("unknown rate limit tier %s for client %s", k.Tier, k.ClientID)
+			}
+			k.rateLimit = tier
+		}
+
+		keys[hash] = k
+	}
+
+	s.mx.Lock()
+	s.keys = keys
+	s.mx.Unlock()
+
+	s.logger.Info("api keys loaded", tel.String("file", s.conf.File), tel.Int("count", len(keys)))
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"envoy.apiconf"
+	"github.com/tel-io/tel/v2"
+
+	v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+func TestAPIKeyStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "api-keys.yaml")
+	// sha256 of "secret-key"
+	err := os.WriteFile(file, []byte(`
+tiers:
+  basic: {period: 1m, count: 2}
+keys:
+  - client_id: billing
+    hash: 85DBE15D75EF9308C7AE0F33C7A324CC6F4BF519A2ED2F3027BD33C140A4F9AA
+    permissions: [payment:charge]
+    tier: basic
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := tel.NewNull()
+	store, err := NewAPIKeyStore(&apiconf.APIKeysConf{File: file}, &logger)
+	if err != nil {
+		t.Fatalf("NewAPIKeyStore() error = %v", err)
+	}
+	defer store.Close()
+
+	client, ok := store.Lookup("secret-key")
+	if !ok {
+		t.Fatalf("Lookup() didn't find the key")
+	}
+	if client.ClientID != "billing" || !client.Grants().HasPermission("payment:charge") || client.Grants().HasPermission("payment:refund") {
+		t.Errorf("Lookup() returned wrong client %+v", client)
+	}
+	if client.rateLimit == nil || client.rateLimit.Count != 2 {
+		t.Errorf("rate limit tier is not resolved: %+v", client.rateLimit)
+	}
+
+	if _, ok := store.Lookup("wrong-key"); ok {
+		t.Errorf("Lookup() accepted unknown key")
+	}
+
+	if err := os.WriteFile(file, []byte("keys: [{client_id: broken, hash: xyz}]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.load(); err == nil {
+		t.Errorf("load() accepted invalid hash")
+	}
+	if _, ok := store.Lookup("secret-key"); !ok {
+		t.Errorf("previous keys are lost after failed reload")
+	}
+}
+
+func TestCheckAPIKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "api-keys.yaml")
+	// sha256 of "secret-key"
+	err := os.WriteFile(file, []byte(`
+tiers:
+  basic: {period: 1m, count: 1}
+keys:
+  - client_id: billing
+    hash: 85dbe15d75ef9308c7ae0f33c7a324cc6f4bf519a2ed2f3027bd33c140a4f9aa
+    permissions: [payment:charge]
+    tier: basic
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := loadTestConfig(t, `
+api_keys:
+  file: `+file+`
+apis:
+  - name: PaymentAPI
+    methods:
+      - name: charge
+        auth: {policy: api-key, permission: payment:charge}
+      - name: refund
+        auth: {policy: api-key, permission: payment:refund}
+      - name: quote
+        auth: {policy: api-key, permission: payment:charge, mode: shadow}
+`)
+	s := newTestServer(t, cfg)
+	s.apiKeyStore, err = NewAPIKeyStore(cfg.APIKeys, s.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.apiKeyStore.Close()
+
+	key := map[string]string{"x-api-key": "secret-key"}
+	tests := []struct {
+		name         string
+		path         string
+		headers      map[string]string
+		want         v3.StatusCode
+		wantClientID string
+	}{
+		{name: "missing key", path: "/api/PaymentAPI/charge", want: v3.StatusCode_Unauthorized},
+		{name: "bad key", path: "/api/PaymentAPI/charge", headers: map[string]string{"x-api-key": "wrong-key"},
+			want: v3.StatusCode_Unauthorized},
+		{name: "permission denied", path: "/api/PaymentAPI/refund", headers: key, want: v3.StatusCode_Forbidden},
+		{name: "allowed", path: "/api/PaymentAPI/charge", headers: key, wantClientID: "billing"},
+		{name: "tier limit", path: "/api/PaymentAPI/charge", headers: key, want: v3.StatusCode_TooManyRequests},
+		{name: "shadow tier limit", path: "/api/PaymentAPI/quote", headers: key, wantClientID: "billing"},
+		{name: "shadow missing key", path: "/api/PaymentAPI/quote", headers: map[string]string{"client-id": "billing"}},
+		{name: "shadow bad key", path: "/api/PaymentAPI/quote",
+			headers: map[string]string{"x-api-key": "wrong-key", "client-id": "billing"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.Check(context.Background(), checkRequest(tt.path, tt.headers))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got v3.StatusCode
+			if denied := resp.GetDeniedResponse(); denied != nil {
+				got = denied.Status.Code
+			}
+			if got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+			if clientID := responseHeader(resp, "client-id"); clientID != tt.wantClientID {
+				t.Errorf("client-id = %q, want %q", clientID, tt.wantClientID)
+			}
+			// the client-id sent by the caller doesn't reach the upstream
+			if tt.want == 0 && tt.wantClientID == "" && !removesHeader(resp, "client-id") {
+				t.Errorf("client-id is not removed")
+			}
+		})
+	}
+}
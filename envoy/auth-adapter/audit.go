@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"envoy.apiconf"
+	"github.com/tel-io/tel/v2"
+	"github.com/tel-io/tel/v2/otlplog/logskd"
+	"github.com/tel-io/tel/v2/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	auditAllow = "allow"
+	auditDeny  = "deny"
+)
+
+// auditRecord is one authorization decision, Check fills it while the request is checked
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	RequestID   string    `json:"request_id,omitempty"`
+	ClientIP    string    `json:"client_ip,omitempty"`
+	Service     string    `json:"service,omitempty"`
+	Method      string    `json:"method,omitempty"`
+	Policy      string    `json:"policy,omitempty"`
+	UserID      string    `json:"user_id,omitempty"`
+	TokenSource string    `json:"token_source,omitempty"` // e.g. header:authorization
+	ClientID    string    `json:"client_id,omitempty"`    // api-key clients
+	ServiceID   string    `json:"service_id,omitempty"`   // mtls services
+	Decision    string    `json:"decision"`
+	Status      int       `json:"status,omitempty"` // HTTP status of denied requests
+	Reason      string    `json:"reason,omitempty"`
+	LatencyMS   float64   `json:"latency_ms"`
+
+	rule string // matched method rule, empty for service rules
+}
+
+func (r *auditRecord) attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("request_id", r.RequestID),
+		attribute.String("client_ip", r.ClientIP),
+		attribute.String("service", r.Service),
+		attribute.String("method", r.Method),
+		attribute.String("policy", r.Policy),
+		attribute.String("user_id", r.UserID),
+		attribute.String("token_source", r.TokenSource),
+		attribute.String("client_id", r.ClientID),
+		attribute.String("service_id", r.ServiceID),
+		attribute.String("decision", r.Decision),
+		attribute.Int("status", r.Status),
+		attribute.String("reason", r.Reason),
+		attribute.Float64("latency_ms", r.LatencyMS),
+	}
+}
+
+// AuditLog writes decision records to a rotating file and to an OTLP logs collector,
+// denials are always written and allows are sampled
+type AuditLog struct {
+	logger     *tel.Telemetry
+	sampleRate float64
+
+	file *rotatingFile
+	otlp logskd.LogProcessor
+}
+
+func NewAuditLog(ctx context.Context, conf *apiconf.AuditConf, logger *tel.Telemetry) (*AuditLog, error) {
+	a := &AuditLog{
+		logger:     logger,
+		sampleRate: conf.GetAllowSampleRate(),
+	}
+
+	if conf.File != "" {
+		f, err := openRotatingFile(conf.File, int64(conf.GetMaxSize())<<20, conf.GetMaxBackups())
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+
+	if conf.OTLP != nil {
+		opts := []otlploggrpc.Option{otlploggrpc.WithEndpoint(conf.OTLP.Endpoint)}
+		if conf.OTLP.Insecure {
+			opts = append(opts, otlploggrpc.WithInsecure())
+		}
+
+		exporter, err := otlploggrpc.New(ctx, tel.CreateRes(ctx, tel.GetConfigFromEnv()), opts...)
+		if err != nil {
+			a.Close()
+			return nil, fmt.Errorf("create otlp exporter: %w", err)
+		}
+		a.otlp = logskd.NewBatchLogProcessor(exporter)
+	}
+
+	return a, nil
+}
+
+// Write records the decision unless the allowed request is not sampled
+func (a *AuditLog) Write(r *auditRecord) {
+	if r.Decision == auditAllow && a.sampleRate < 1 && rand.Float64() >= a.sampleRate {
+		return
+	}
+
+	if a.file != nil {
+		data, err := json.Marshal(r)
+		if err == nil {
+			_, err = a.file.Write(append(data, '\n'))
+		}
+		if err != nil {
+			a.logger.Error("audit record is not written", tel.Error(err))
+		}
+	}
+
+	if a.otlp != nil {
+		level := zapcore.InfoLevel
+		if r.Decision == auditDeny {
+			level = zapcore.WarnLevel
+		}
+		a.otlp.Write(logskd.NewLog(zapcore.Entry{LoggerName: "audit", Time: r.Time, Level: level}, r.attributes()...))
+	}
+}
+
+// Close flushes pending OTLP records and closes the file
+func (a *AuditLog) Close() {
+	if a.otlp != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := a.otlp.Shutdown(ctx); err != nil {
+			a.logger.Error("audit otlp exporter shutdown", tel.Error(err))
+		}
+	}
+
+	if a.file != nil {
+		a.file.Close()
+	}
+}
+
+// rotatingFile renames the file to file.1 when it exceeds maxSize, file.1 becomes file.2
+// and so on, the files after maxBackups are removed
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	mx   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	return r.f.Close()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f, r.size = f, st.Size()
+
+	return nil
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	// when renaming fails the file is reopened and the next write tries again
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	os.Rename(r.path, r.path+".1")
+
+	return r.open()
+}
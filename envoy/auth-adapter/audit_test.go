@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"envoy.apiconf"
+	"github.com/tel-io/tel/v2"
+	"golang.org/x/net/context"
+)
+
+func TestRotatingFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	r, err := openRotatingFile(file, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := map[string]string{file: "fourth\n", file + ".1": "third\n", file + ".2": "second\n"}
+	for f, content := range want {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", filepath.Base(f), data, content)
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Errorf("backups over max_backups are kept")
+	}
+}
+
+func TestCheckAuditLog(t *testing.T) {
+	logger := tel.NewNull()
+	file := filepath.Join(t.TempDir(), "audit.log")
+	noAllows := 0.0
+	audit, err := NewAuditLog(context.Background(), &apiconf.AuditConf{File: file, AllowSampleRate: &noAllows}, &logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := loadTestConfig(t, `
+apis:
+  - name: Users
+    methods:
+      - name: Get
+        auth: {policy: no-need}
+      - name: Update
+        auth: {policy: required, permission: "user:write"}
+`)
+	s := newTestServer(t, cfg)
+	s.auditLog = audit
+
+	headers := map[string]string{"x-request-id": "req-1", "x-real-ip": "10.0.0.1"}
+	for _, path := range []string{"/api/Users/Get", "/api/Users/Update"} {
+		if _, err := s.Check(context.Background(), checkRequest(path, headers)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	headers["authorization"] = "Bearer demo-token"
+	if _, err := s.Check(context.Background(), checkRequest("/api/Users/Update", headers)); err != nil {
+		t.Fatal(err)
+	}
+	audit.Close()
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid audit record %s: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+
+	// allows are not sampled, denials are always written
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	rec := records[0]
+	if rec.RequestID != "req-1" || rec.ClientIP != "10.0.0.1" || rec.Method != "Users/Update" ||
+		rec.Policy != apiconf.PolicyRequired || rec.Decision != auditDeny || rec.Status != 401 ||
+		!strings.Contains(rec.Reason, "token required") || rec.TokenSource != "" {
+		t.Errorf("unexpected audit record %+v", rec)
+	}
+	if rec := records[1]; rec.Status != 403 || rec.UserID != "demo-user-123" || rec.TokenSource != "header:authorization" {
+		t.Errorf("unexpected audit record of the token without permission %+v", rec)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"envoy.apiconf"
+	"github.com/tel-io/tel/v2"
+)
+
+// CaptchaVerifier checks captcha tokens with the siteverify endpoint of the provider. Challenge tokens
+// let users pass rate limits, they are checked against the hostnames of the policy only.
+// The result is rcPassed or the reason of the failure.
+type CaptchaVerifier interface {
+	Verify(token string, challenge bool, policy apiconf.ReCaptchaConf) string
+}
+
+var (
+	_ CaptchaVerifier = &RecaptchaProcessor{}
+	_ CaptchaVerifier = &HCaptchaVerifier{}
+	_ CaptchaVerifier = &TurnstileVerifier{}
+)
+
+// error codes of expired or already verified tokens
+const (
+	hcErrInvalidOrAlreadySeen = "invalid-or-already-seen-response"
+	tsErrTimeoutOrDuplicate   = rcErrTimeoutOrDuplicate
+)
+
+// siteVerifier posts tokens to a siteverify endpoint, reCaptcha, hCaptcha and Turnstile
+// share the request form and the response shape
+type siteVerifier struct {
+	provider string
+	httpCli  *http.Client
+	url      string
+	logger   *tel.Telemetry
+}
+
+func newSiteVerifier(provider, verifyURL string, logger *tel.Telemetry) siteVerifier {
+	return siteVerifier{
+		provider: provider,
+		httpCli:  &http.Client{Timeout: 10 * time.Second},
+		url:      verifyURL,
+		logger:   logger,
+	}
+}
+
+// verify calls the endpoint and classifies the answer, failed calls are rcUnavailable
+func (sv *siteVerifier) verify(secret, token string, challenge bool, classify func(*RecaptchaResponse) string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("response", token)
+
+	prefix := token
+	if len(prefix) > 20 {
+		prefix = prefix[:20]
+	}
+	log := sv.logger.With(tel.String("provider", sv.provider), tel.String("token_prefix", prefix),
+		tel.Bool("challenge", challenge))
+
+	resp, err := sv.httpCli.PostForm(sv.url, params)
+	if err != nil {
+		log.Error("captcha verification", tel.String("POST", sv.url), tel.Error(err))
+		return rcUnavailable
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		log.Error("captcha verification failed", tel.String("POST", sv.url),
+			tel.String("status", resp.Status))
+		return rcUnavailable
+	}
+
+	verifyResp := RecaptchaResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&verifyResp)
+	if err != nil {
+		log.Error("captcha verification json response decode failed", tel.Error(err))
+		return rcUnavailable
+	}
+
+	result := classify(&verifyResp)
+	if result != rcPassed {
+		log.Warn("captcha is not passed", tel.String("result", result), tel.Any("resp", verifyResp))
+	} else {
+		log.Debug("captcha verification response", tel.Any("resp", verifyResp))
+	}
+
+	return result
+}
+
+// failure classifies unsuccessful answers, expiredCode is the error code of expired or reused tokens
+func failure(resp *RecaptchaResponse, expiredCode string) string {
+	for _, code := range resp.ErrCodes {
+		if code == expiredCode {
+			return rcExpired
+		}
+	}
+
+	return rcInvalid
+}
+
+// HCaptchaVerifier checks hCaptcha tokens, the score of hCaptcha Enterprise is a risk score
+// and it is not compared with min_score
+type HCaptchaVerifier struct {
+	siteVerifier
+	secret string
+}
+
+func NewHCaptchaVerifier(verifyURL, secret string, logger *tel.Telemetry) *HCaptchaVerifier {
+	return &HCaptchaVerifier{
+		siteVerifier: newSiteVerifier(apiconf.CaptchaHCaptcha, verifyURL, logger),
+		secret:       secret,
+	}
+}
+
+func (v *HCaptchaVerifier) Verify(token string, challenge bool, policy apiconf.ReCaptchaConf) string {
+	return v.verify(v.secret, token, challenge, func(resp *RecaptchaResponse) string {
+		if !resp.Success {
+			return failure(resp, hcErrInvalidOrAlreadySeen)
+		}
+		if !policy.AllowHostname(resp.Hostname) {
+			return rcWrongHostname
+		}
+
+		return rcPassed
+	})
+}
+
+// TurnstileVerifier checks Cloudflare Turnstile tokens, they have no score
+type TurnstileVerifier struct {
+	siteVerifier
+	secret string
+}
+
+func NewTurnstileVerifier(verifyURL, secret string, logger *tel.Telemetry) *TurnstileVerifier {
+	return &TurnstileVerifier{
+		siteVerifier: newSiteVerifier(apiconf.CaptchaTurnstile, verifyURL, logger),
+		secret:       secret,
+	}
+}
+
+func (v *TurnstileVerifier) Verify(token string, challenge bool, policy apiconf.ReCaptchaConf) string {
+	return v.verify(v.secret, token, challenge, func(resp *RecaptchaResponse) string {
+		if !resp.Success {
+			return failure(resp, tsErrTimeoutOrDuplicate)
+		}
+		if !policy.AllowHostname(resp.Hostname) {
+			return rcWrongHostname
+		}
+		if !challenge && policy.Action != "" && resp.Action != policy.Action {
+			return rcWrongAction
+		}
+
+		return rcPassed
+	})
+}
+
+// newCaptchaVerifiers creates verifiers of the providers with secrets, reCaptcha is enabled by its URL.
+// Endpoints of hCaptcha and Turnstile are set in the captcha section of the config.
+func newCaptchaVerifiers(captcha *apiconf.CaptchaConf, rcConf *RCConf, logger *tel.Telemetry) map[string]CaptchaVerifier {
+	verifiers := make(map[string]CaptchaVerifier)
+	if rcConf.URL != "" {
+		verifiers[apiconf.CaptchaReCaptcha] = NewRecaptchaProcessor(rcConf, logger)
+	}
+	if rcConf.HCaptchaSecret != "" {
+		verifiers[apiconf.CaptchaHCaptcha] = NewHCaptchaVerifier(
+			captcha.ProviderConf(apiconf.CaptchaHCaptcha).URL, rcConf.HCaptchaSecret, logger)
+	}
+	if rcConf.TurnstileSecret != "" {
+		verifiers[apiconf.CaptchaTurnstile] = NewTurnstileVerifier(
+			captcha.ProviderConf(apiconf.CaptchaTurnstile).URL, rcConf.TurnstileSecret, logger)
+	}
+
+	return verifiers
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"envoy.apiconf"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/tel-io/tel/v2"
+)
+
+// verifyServer is a siteverify endpoint accepting the token "pass" with the secret
+func verifyServer(t *testing.T, secret string, answer RecaptchaResponse) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("secret") != secret {
+			json.NewEncoder(w).Encode(RecaptchaResponse{ErrCodes: []string{"invalid-input-secret"}})
+			return
+		}
+		if r.PostFormValue("response") != "pass" {
+			json.NewEncoder(w).Encode(RecaptchaResponse{ErrCodes: []string{"invalid-input-response"}})
+			return
+		}
+		json.NewEncoder(w).Encode(answer)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestCaptchaVerifiers(t *testing.T) {
+	logger := tel.NewNull()
+	signup := apiconf.ReCaptchaConf{Enabled: true, Action: "signup", Hostnames: []string{"example.com"}}
+
+	var answer RecaptchaResponse
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(answer)
+	}))
+	defer srv.Close()
+
+	hcaptcha := NewHCaptchaVerifier(srv.URL, "secret", &logger)
+	turnstile := NewTurnstileVerifier(srv.URL, "secret", &logger)
+
+	tests := []struct {
+		name      string
+		verifier  CaptchaVerifier
+		answer    RecaptchaResponse
+		challenge bool
+		want      string
+	}{
+		{
+			name:     "hcaptcha passed",
+			verifier: hcaptcha,
+			answer:   RecaptchaResponse{Success: true, Hostname: "example.com"},
+			want:     rcPassed,
+		},
+		{
+			name:     "hcaptcha ignores the risk score",
+			verifier: hcaptcha,
+			answer:   RecaptchaResponse{Success: true, Hostname: "example.com", Score: new(float64)},
+			want:     rcPassed,
+		},
+		{
+			name:     "hcaptcha wrong hostname",
+			verifier: hcaptcha,
+			answer:   RecaptchaResponse{Success: true, Hostname: "evil.com"},
+			want:     rcWrongHostname,
+		},
+		{
+			name:     "hcaptcha already seen",
+			verifier: hcaptcha,
+			answer:   RecaptchaResponse{ErrCodes: []string{hcErrInvalidOrAlreadySeen}},
+			want:     rcExpired,
+		},
+		{
+			name:     "turnstile passed",
+			verifier: turnstile,
+			answer:   RecaptchaResponse{Success: true, Action: "signup", Hostname: "example.com"},
+			want:     rcPassed,
+		},
+		{
+			name:     "turnstile wrong action",
+			verifier: turnstile,
+			answer:   RecaptchaResponse{Success: true, Action: "login", Hostname: "example.com"},
+			want:     rcWrongAction,
+		},
+		{
+			name:      "turnstile challenge checks hostname only",
+			verifier:  turnstile,
+			answer:    RecaptchaResponse{Success: true, Action: "login", Hostname: "example.com"},
+			challenge: true,
+			want:      rcPassed,
+		},
+		{
+			name:     "turnstile expired",
+			verifier: turnstile,
+			answer:   RecaptchaResponse{ErrCodes: []string{tsErrTimeoutOrDuplicate}},
+			want:     rcExpired,
+		},
+		{
+			name:     "turnstile invalid",
+			verifier: turnstile,
+			answer:   RecaptchaResponse{ErrCodes: []string{"invalid-input-response"}},
+			want:     rcInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer = tt.answer
+			if got := tt.verifier.Verify("token", tt.challenge, signup); got != tt.want {
+				t.Errorf("Verify() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	down := NewHCaptchaVerifier("http://127.0.0.1:1/siteverify", "secret", &logger)
+	if got := down.Verify("token", false, signup); got != rcUnavailable {
+		t.Errorf("Verify() of unreachable endpoint = %s, want %s", got, rcUnavailable)
+	}
+}
+
+func TestCheckCaptchaProviders(t *testing.T) {
+	logger := tel.NewNull()
+
+	score := 0.9
+	recaptcha := verifyServer(t, "rc-secret", RecaptchaResponse{Success: true, Score: &score})
+	hcaptcha := verifyServer(t, "hc-secret", RecaptchaResponse{Success: true})
+	turnstile := verifyServer(t, "ts-secret", RecaptchaResponse{Success: true})
+
+	cfg := loadTestConfig(t, `
+apis:
+  - name: Users
+    auth: {policy: no-need, need_recaptcha: true}
+    methods:
+      - name: Signup
+        auth: {policy: no-need, need_recaptcha: true, captcha_provider: hcaptcha}
+      - name: Login
+        auth: {policy: no-need, need_recaptcha: true, captcha_provider: recaptcha}
+  - name: Game
+    auth: {policy: no-need, need_recaptcha: true, captcha_provider: hcaptcha}
+captcha:
+  provider: turnstile
+  turnstile: {url: `+turnstile.URL+`, token_header: x-captcha}
+  hcaptcha: {url: `+hcaptcha.URL+`}
+`)
+	s := newTestServer(t, cfg)
+	s.captchaVerifiers = newCaptchaVerifiers(cfg.Captcha, &RCConf{
+		URL: recaptcha.URL, SecretV3: "rc-secret", MinScore: 0.5, TurnstileSecret: "ts-secret",
+	}, &logger)
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		want    v3.StatusCode
+	}{
+		{name: "default provider", path: "/api/Users/Get", headers: map[string]string{"x-captcha": "pass"}},
+		{name: "default provider header", path: "/api/Users/Get", headers: map[string]string{"x-turnstile-token": "pass"},
+			want: v3.StatusCode_PreconditionFailed},
+		{name: "default provider invalid token", path: "/api/Users/Get", headers: map[string]string{"x-captcha": "fail"},
+			want: v3.StatusCode_PreconditionFailed},
+		{name: "method provider", path: "/api/Users/Login", headers: map[string]string{"x-rc-token": "pass"}},
+		// providers without secrets are not enabled, their checks are switched off
+		{name: "method provider without secret", path: "/api/Users/Signup"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.Check(context.Background(), checkRequest(tt.path, tt.headers))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got v3.StatusCode
+			if denied := resp.GetDeniedResponse(); denied != nil {
+				got = denied.Status.Code
+			}
+			if got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	s.captchaVerifiers[apiconf.CaptchaHCaptcha] = NewHCaptchaVerifier(hcaptcha.URL, "hc-secret", &logger)
+	resp, err := s.Check(context.Background(), checkRequest("/api/Game/Play", map[string]string{"x-hcaptcha-token": "pass"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if denied := resp.GetDeniedResponse(); denied != nil {
+		t.Errorf("API provider: status = %v, want OK", denied.Status.Code)
+	}
+	resp, err = s.Check(context.Background(), checkRequest("/api/Game/Play", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if denied := resp.GetDeniedResponse(); denied == nil || denied.Status.Code != v3.StatusCode_PreconditionFailed {
+		t.Errorf("API provider without token: response = %v, want PreconditionFailed", resp)
+	}
+}
+
+func TestCaptchaProvidersReadiness(t *testing.T) {
+	logger := tel.NewNull()
+	cfg := loadTestConfig(t, `
+apis:
+  - name: Users
+    methods:
+      - name: Login
+        auth: {policy: no-need, need_recaptcha: true}
+      - name: Signup
+        auth: {policy: no-need, need_recaptcha: true, captcha_provider: hcaptcha}
+  - name: Game
+    auth: {policy: no-need, rate_limit: {period: 1m, count: 1}, captcha_provider: turnstile}
+`)
+	s := newTestServer(t, cfg)
+	recaptcha := NewRecaptchaProcessor(&RCConf{URL: "http://127.0.0.1:1/siteverify"}, &logger)
+	hcaptcha := NewHCaptchaVerifier("http://127.0.0.1:1/siteverify", "secret", &logger)
+	turnstile := NewTurnstileVerifier("http://127.0.0.1:1/siteverify", "secret", &logger)
+
+	tests := []struct {
+		name      string
+		verifiers map[string]CaptchaVerifier
+		wantErr   string
+	}{
+		{name: "captcha is switched off"},
+		{name: "rule provider is not enabled", verifiers: map[string]CaptchaVerifier{apiconf.CaptchaReCaptcha: recaptcha},
+			wantErr: "captcha providers hcaptcha, turnstile are used by the config but not enabled"},
+		{name: "all providers are enabled", verifiers: map[string]CaptchaVerifier{
+			apiconf.CaptchaReCaptcha: recaptcha, apiconf.CaptchaHCaptcha: hcaptcha, apiconf.CaptchaTurnstile: turnstile,
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.captchaVerifiers = tt.verifiers
+			err := s.readiness()
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("readiness() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package extAuth
 
 import (
+	"time"
+
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 )
@@ -17,6 +19,7 @@ type ValidateSessionResponse struct {
 	UserId    string
 	SessionId string
 	Roles     []*Role
+	ExpiresAt time.Time // of the token, zero when the validator doesn't know it
 }
 
 type Role struct {
@@ -0,0 +1,168 @@
+package extAuth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"envoy.apiconf"
+	"google.golang.org/grpc"
+)
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerOpenTimeout      = 30 * time.Second
+	defaultBreakerHalfOpenRequests = 1
+)
+
+// ErrCircuitOpen is returned without calling the backend while the breaker is open
+var ErrCircuitOpen = fmt.Errorf("%w: circuit breaker is open", ErrUnavailable)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "half-open"
+	}
+}
+
+type CircuitBreakerConfig = apiconf.CircuitBreakerConfig
+
+// CircuitBreaker stops calling the backend after consecutive failures. Only backend
+// failures (see IsUnavailable) are counted, rejected tokens are successful calls and
+// calls canceled by the caller are not counted at all.
+type CircuitBreaker struct {
+	client AuthSessionServiceClient
+	cfg    CircuitBreakerConfig
+	now    func() time.Time
+
+	// OnStateChange is called on every transition, under the breaker lock
+	OnStateChange func(from, to BreakerState)
+
+	mx       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probes   int
+}
+
+var _ AuthSessionServiceClient = &CircuitBreaker{}
+
+func NewCircuitBreaker(client AuthSessionServiceClient, cfg CircuitBreakerConfig) *CircuitBreaker {
+	if cfg.FailureThreshold == 0 {
+		cfg.FailureThreshold = defaultBreakerFailureThreshold
+	}
+	if cfg.OpenTimeout == 0 {
+		cfg.OpenTimeout = defaultBreakerOpenTimeout
+	}
+	if cfg.HalfOpenRequests == 0 {
+		cfg.HalfOpenRequests = defaultBreakerHalfOpenRequests
+	}
+
+	return &CircuitBreaker{
+		client: client,
+		cfg:    cfg,
+		now:    time.Now,
+	}
+}
+
+func (b *CircuitBreaker) ValidateSession(ctx context.Context, req *ValidateSessionRequest, opt ...grpc.CallOption) (
+	*ValidateSessionResponse, error) {
+	if !b.allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	resp, err := b.client.ValidateSession(ctx, req, opt...)
+	if IsCanceled(err) {
+		b.release()
+	} else {
+		b.done(IsUnavailable(err))
+	}
+
+	return resp, err
+}
+
+func (b *CircuitBreaker) State() BreakerState {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	return b.state
+}
+
+func (b *CircuitBreaker) allow() bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.cfg.OpenTimeout {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		b.probes = 1
+
+		return true
+	case BreakerHalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			return false
+		}
+		b.probes++
+
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *CircuitBreaker) done(failed bool) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if !failed {
+		b.failures = 0
+		if b.state == BreakerHalfOpen {
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.cfg.FailureThreshold) {
+		b.openedAt = b.now()
+		b.setState(BreakerOpen)
+	}
+}
+
+// release frees the probe slot of the call which ended without a result
+func (b *CircuitBreaker) release() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *CircuitBreaker) setState(to BreakerState) {
+	from := b.state
+	b.state = to
+	if to == BreakerClosed || to == BreakerOpen {
+		b.probes = 0
+	}
+
+	if b.OnStateChange != nil && from != to {
+		b.OnStateChange(from, to)
+	}
+}
@@ -0,0 +1,97 @@
+package extAuth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	client := &countingClient{}
+	b := NewCircuitBreaker(client, CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: 10 * time.Second})
+	b.now = func() time.Time { return now }
+
+	var transitions []string
+	b.OnStateChange = func(from, to BreakerState) {
+		transitions = append(transitions, from.String()+"->"+to.String())
+	}
+
+	validate := func(token string) error {
+		_, err := b.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: token})
+		return err
+	}
+
+	// rejected tokens are not backend failures
+	_ = validate("invalid")
+	_ = validate("invalid")
+	if b.State() != BreakerClosed {
+		t.Fatalf("breaker is opened by invalid tokens")
+	}
+
+	_ = validate("down")
+	_ = validate("down")
+	if err := validate("valid"); !errors.Is(err, ErrCircuitOpen) || !IsUnavailable(err) {
+		t.Fatalf("open breaker error = %v", err)
+	}
+	if client.calls != 4 {
+		t.Errorf("backend is called while breaker is open, calls = %d", client.calls)
+	}
+
+	now = now.Add(11 * time.Second)
+	_ = validate("down") // failed probe opens it again
+	if b.State() != BreakerOpen {
+		t.Fatalf("failed probe must open the breaker, state = %s", b.State())
+	}
+
+	now = now.Add(11 * time.Second)
+	if err := validate("valid"); err != nil {
+		t.Fatalf("probe error = %v", err)
+	}
+
+	want := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if len(transitions) != len(want) {
+		t.Fatalf("transitions = %v, want %v", transitions, want)
+	}
+	for i := range want {
+		if transitions[i] != want[i] {
+			t.Errorf("transitions = %v, want %v", transitions, want)
+			break
+		}
+	}
+}
+
+func TestCircuitBreakerCanceledCalls(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := NewCircuitBreaker(&countingClient{}, CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: 10 * time.Second})
+	b.now = func() time.Time { return now }
+
+	validate := func(token string) error {
+		_, err := b.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: token})
+		return err
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := validate("canceled"); IsUnavailable(err) || !IsCanceled(err) {
+			t.Fatalf("canceled call error = %v", err)
+		}
+	}
+	if b.State() != BreakerClosed {
+		t.Fatalf("breaker is opened by canceled calls")
+	}
+
+	_ = validate("down")
+	now = now.Add(11 * time.Second)
+	// the canceled probe frees its slot and keeps the breaker half-open
+	_ = validate("canceled")
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("canceled probe changed the state to %s", b.State())
+	}
+	if err := validate("valid"); err != nil {
+		t.Fatalf("probe after the canceled one error = %v", err)
+	}
+	if b.State() != BreakerClosed {
+		t.Errorf("successful probe must close the breaker, state = %s", b.State())
+	}
+}
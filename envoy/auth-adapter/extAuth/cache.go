@@ -0,0 +1,253 @@
+package extAuth
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"envoy.apiconf"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultSessionCacheSize        = 10000
+	defaultSessionCacheCallTimeout = apiconf.DefaultAuthBackendTimeout
+)
+
+// ErrUnavailable marks errors of the auth backend itself, such results say nothing about the token
+var ErrUnavailable = errors.New("auth backend is unavailable")
+
+// IsUnavailable reports whether the token could not be checked because of the backend failure
+func IsUnavailable(err error) bool {
+	if errors.Is(err, ErrUnavailable) {
+		return true
+	}
+
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	default:
+		return errors.Is(err, context.DeadlineExceeded)
+	}
+}
+
+// IsCanceled reports whether the caller gave up, such calls say nothing about the backend or the token
+func IsCanceled(err error) bool {
+	return status.Code(err) == codes.Canceled || errors.Is(err, context.Canceled)
+}
+
+// IsInvalidToken reports whether the token was rejected: local validators reject tokens with
+// plain errors, the auth service with Unauthenticated, PermissionDenied, NotFound or InvalidArgument.
+// Other errors may be transient and say nothing about the token.
+func IsInvalidToken(err error) bool {
+	if err == nil || IsUnavailable(err) || IsCanceled(err) {
+		return false
+	}
+
+	st, ok := status.FromError(err)
+	if !ok {
+		return true
+	}
+
+	switch st.Code() {
+	case codes.Unauthenticated, codes.PermissionDenied, codes.NotFound, codes.InvalidArgument:
+		return true
+	default:
+		return false
+	}
+}
+
+type SessionCacheConfig = apiconf.SessionCacheConfig
+
+type sessionCacheEntry struct {
+	key       [sha256.Size]byte
+	resp      *ValidateSessionResponse
+	err       error
+	expiresAt time.Time
+}
+
+// SessionCache caches ValidateSession results of the wrapped client by the token hash.
+// Valid results are cached for positive_ttl but not after the token expires, rejected tokens
+// for negative_ttl, other errors are never cached. Concurrent lookups of the same token are
+// coalesced into one call which callers leaving early don't cancel.
+type SessionCache struct {
+	client AuthSessionServiceClient
+	cfg    SessionCacheConfig
+	now    func() time.Time
+
+	// OnLookup is called on every lookup with its result, results of the backend calls are misses
+	OnLookup func(hit bool)
+	// CallTimeout is the deadline of the shared backend call, 5s when not set
+	CallTimeout time.Duration
+
+	group singleflight.Group
+
+	mx      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+}
+
+var _ AuthSessionServiceClient = &SessionCache{}
+
+func NewSessionCache(client AuthSessionServiceClient, cfg SessionCacheConfig) *SessionCache {
+	if cfg.MaxEntries == 0 {
+		cfg.MaxEntries = defaultSessionCacheSize
+	}
+
+	return &SessionCache{
+		client:  client,
+		cfg:     cfg,
+		now:     time.Now,
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *SessionCache) ValidateSession(ctx context.Context, req *ValidateSessionRequest, opt ...grpc.CallOption) (
+	*ValidateSessionResponse, error) {
+	key := sha256.Sum256([]byte(req.SessionToken))
+
+	e, ok := c.get(key)
+	if c.OnLookup != nil {
+		c.OnLookup(ok)
+	}
+	if ok {
+		return e.resp, e.err
+	}
+
+	ch := c.group.DoChan(string(key[:]), func() (interface{}, error) {
+		// the call is shared by all waiters, so it doesn't depend on the context of the first one
+		callCtx, cancel := context.WithTimeout(context.Background(), c.callTimeout())
+		defer cancel()
+
+		resp, err := c.client.ValidateSession(callCtx, req, opt...)
+		switch {
+		case err == nil:
+			c.put(key, resp, nil, c.positiveTTL(resp))
+		case IsInvalidToken(err):
+			c.put(key, nil, err, c.cfg.NegativeTTL)
+		}
+
+		return resp, err
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*ValidateSessionResponse), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *SessionCache) callTimeout() time.Duration {
+	if c.CallTimeout <= 0 {
+		return defaultSessionCacheCallTimeout
+	}
+
+	return c.CallTimeout
+}
+
+// positiveTTL is positive_ttl or the time left until the token expires when it is shorter
+func (c *SessionCache) positiveTTL(resp *ValidateSessionResponse) time.Duration {
+	ttl := c.cfg.PositiveTTL
+	if !resp.ExpiresAt.IsZero() {
+		if left := resp.ExpiresAt.Sub(c.now()); left < ttl {
+			ttl = left
+		}
+	}
+
+	return ttl
+}
+
+// Revoke evicts the token, the next request with it is validated by the backend
+func (c *SessionCache) Revoke(token string) {
+	key := sha256.Sum256([]byte(token))
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// RevokeSession evicts all tokens of the session
+func (c *SessionCache) RevokeSession(sessionID string) int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	evicted := 0
+	for _, el := range c.entries {
+		e := el.Value.(*sessionCacheEntry)
+		if e.resp != nil && e.resp.SessionId == sessionID {
+			c.remove(el)
+			evicted++
+		}
+	}
+
+	return evicted
+}
+
+func (c *SessionCache) Len() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *SessionCache) get(key [sha256.Size]byte) (*sessionCacheEntry, bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*sessionCacheEntry)
+	if !c.now().Before(e.expiresAt) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+
+	return e, true
+}
+
+func (c *SessionCache) put(key [sha256.Size]byte, resp *ValidateSessionResponse, err error, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+
+	c.entries[key] = c.lru.PushFront(&sessionCacheEntry{
+		key:       key,
+		resp:      resp,
+		err:       err,
+		expiresAt: c.now().Add(ttl),
+	})
+
+	for c.lru.Len() > c.cfg.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *SessionCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*sessionCacheEntry).key)
+}
@@ -0,0 +1,182 @@
+package extAuth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type countingClient struct {
+	calls     int32
+	delay     time.Duration
+	expiresAt time.Time
+}
+
+func (c *countingClient) ValidateSession(_ context.Context, req *ValidateSessionRequest, _ ...grpc.CallOption) (
+	*ValidateSessionResponse, error) {
+	atomic.AddInt32(&c.calls, 1)
+	time.Sleep(c.delay)
+
+	switch req.SessionToken {
+	case "valid":
+		return &ValidateSessionResponse{UserId: "user", SessionId: "session"}, nil
+	case "expiring":
+		return &ValidateSessionResponse{UserId: "user", ExpiresAt: c.expiresAt}, nil
+	case "down":
+		return nil, status.Error(codes.Unavailable, "connection refused")
+	case "canceled":
+		return nil, status.Error(codes.Canceled, "context canceled")
+	case "internal":
+		return nil, status.Error(codes.Internal, "database error")
+	case "rejected":
+		return nil, status.Error(codes.Unauthenticated, "session is not found")
+	default:
+		return nil, errors.New("invalid token")
+	}
+}
+
+func TestSessionCache(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	client := &countingClient{}
+	cache := NewSessionCache(client, SessionCacheConfig{PositiveTTL: time.Minute, NegativeTTL: 10 * time.Second, MaxEntries: 2})
+	cache.now = func() time.Time { return now }
+
+	validate := func(token string) error {
+		_, err := cache.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: token})
+		return err
+	}
+	expectCalls := func(want int32) {
+		t.Helper()
+		if got := atomic.SwapInt32(&client.calls, 0); got != want {
+			t.Errorf("backend calls = %d, want %d", got, want)
+		}
+	}
+
+	_ = validate("valid")
+	_ = validate("valid")
+	expectCalls(1)
+
+	_ = validate("invalid")
+	if err := validate("invalid"); err == nil {
+		t.Errorf("cached negative result lost the error")
+	}
+	expectCalls(1)
+
+	_ = validate("down")
+	_ = validate("down")
+	expectCalls(2)
+
+	// negative entries expire earlier than positive ones
+	now = now.Add(30 * time.Second)
+	_ = validate("valid")
+	_ = validate("invalid")
+	expectCalls(1)
+
+	cache.Revoke("valid")
+	_ = validate("valid")
+	expectCalls(1)
+
+	if n := cache.RevokeSession("session"); n != 1 {
+		t.Errorf("RevokeSession() = %d, want 1", n)
+	}
+
+	_ = validate("a")
+	_ = validate("b")
+	_ = validate("c")
+	if cache.Len() != 2 {
+		t.Errorf("cache size = %d, max is 2", cache.Len())
+	}
+	expectCalls(3)
+
+	// transient server errors are not cached, rejections of the auth service are
+	_ = validate("internal")
+	_ = validate("internal")
+	expectCalls(2)
+	_ = validate("rejected")
+	_ = validate("rejected")
+	expectCalls(1)
+}
+
+func TestSessionCacheCoalescing(t *testing.T) {
+	client := &countingClient{delay: 50 * time.Millisecond}
+	cache := NewSessionCache(client, SessionCacheConfig{PositiveTTL: time.Minute})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: "valid"}); err != nil {
+				t.Errorf("ValidateSession() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&client.calls); calls != 1 {
+		t.Errorf("concurrent lookups are not coalesced, calls = %d", calls)
+	}
+}
+
+func TestSessionCacheTokenExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	client := &countingClient{expiresAt: now.Add(10 * time.Second)}
+	cache := NewSessionCache(client, SessionCacheConfig{PositiveTTL: time.Minute})
+	cache.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: "expiring"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls := atomic.SwapInt32(&client.calls, 0); calls != 1 {
+		t.Errorf("backend calls = %d, want 1", calls)
+	}
+
+	// positive_ttl is not over yet, the token is
+	now = now.Add(10 * time.Second)
+	if _, err := cache.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: "expiring"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&client.calls); calls != 1 {
+		t.Errorf("expired token is served from cache")
+	}
+}
+
+func TestSessionCacheCallerCancel(t *testing.T) {
+	client := &countingClient{delay: 50 * time.Millisecond}
+	cache := NewSessionCache(client, SessionCacheConfig{PositiveTTL: time.Minute})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := cache.ValidateSession(ctx, &ValidateSessionRequest{SessionToken: "valid"})
+		first <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	second := make(chan error, 1)
+	go func() {
+		_, err := cache.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: "valid"})
+		second <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled caller error = %v, want context.Canceled", err)
+	}
+	if err := <-second; err != nil {
+		t.Errorf("waiter got the cancellation of the first caller: %v", err)
+	}
+	if calls := atomic.LoadInt32(&client.calls); calls != 1 {
+		t.Errorf("backend calls = %d, want 1", calls)
+	}
+}
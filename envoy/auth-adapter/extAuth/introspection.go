@@ -0,0 +1,236 @@
+package extAuth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"envoy.apiconf"
+	"google.golang.org/grpc"
+)
+
+const (
+	defaultIntrospectionCacheTTL = 5 * time.Minute
+	maxIntrospectionCacheSize    = 10000
+
+	// IntrospectionSecretEnv is used when client_secret is not set in the config
+	IntrospectionSecretEnv = "INTROSPECTION_CLIENT_SECRET"
+)
+
+var (
+	errTokenInactive  = errors.New("token is not active")
+	errTokenNoSubject = errors.New("active token has neither sub nor client_id")
+)
+
+type IntrospectionConfig = apiconf.IntrospectionConfig
+
+// introspectionResponse is RFC 7662 section 2.2 response
+type introspectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope"`
+	ClientID  string `json:"client_id"`
+	Username  string `json:"username"`
+	Sub       string `json:"sub"`
+	Sid       string `json:"sid"`
+	Exp       int64  `json:"exp"`
+	TokenType string `json:"token_type"`
+}
+
+type introspectionEntry struct {
+	resp      *ValidateSessionResponse
+	expiresAt time.Time
+}
+
+// IntrospectionClient validates opaque OAuth2 tokens with RFC 7662 token introspection,
+// active responses are cached until the token expires.
+type IntrospectionClient struct {
+	cfg     IntrospectionConfig
+	httpCli *http.Client
+	now     func() time.Time
+
+	mx         sync.Mutex
+	cache      map[[sha256.Size]byte]introspectionEntry
+	maxEntries int
+}
+
+var _ AuthSessionServiceClient = &IntrospectionClient{}
+
+func NewIntrospectionClient(cfg IntrospectionConfig) *IntrospectionClient {
+	if cfg.MaxCacheTTL == 0 {
+		cfg.MaxCacheTTL = defaultIntrospectionCacheTTL
+	}
+	if cfg.ClientSecret == "" {
+		cfg.ClientSecret = os.Getenv(IntrospectionSecretEnv)
+	}
+
+	return &IntrospectionClient{
+		cfg:     cfg,
+		httpCli: &http.Client{Timeout: 10 * time.Second},
+		now:     time.Now,
+		cache:   make(map[[sha256.Size]byte]introspectionEntry),
+
+		maxEntries: maxIntrospectionCacheSize,
+	}
+}
+
+func (c *IntrospectionClient) ValidateSession(ctx context.Context, req *ValidateSessionRequest, _ ...grpc.CallOption) (
+	*ValidateSessionResponse, error) {
+	key := sha256.Sum256([]byte(req.SessionToken))
+
+	c.mx.Lock()
+	entry, ok := c.cache[key]
+	c.mx.Unlock()
+	if ok && c.now().Before(entry.expiresAt) {
+		return entry.resp, nil
+	}
+
+	ir, err := c.introspect(ctx, req.SessionToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ir.Active {
+		return nil, errTokenInactive
+	}
+
+	resp := c.mapResponse(ir)
+	if resp.UserId == "" {
+		return nil, errTokenNoSubject
+	}
+
+	expiresAt := c.now().Add(c.cfg.MaxCacheTTL)
+	if ir.Exp > 0 {
+		exp := time.Unix(ir.Exp, 0)
+		if !exp.After(c.now()) {
+			return nil, errTokenExpired
+		}
+		resp.ExpiresAt = exp
+		if exp.Before(expiresAt) {
+			expiresAt = exp
+		}
+	}
+	c.store(key, introspectionEntry{resp: resp, expiresAt: expiresAt})
+
+	return resp, nil
+}
+
+// Revoke evicts the token, the next request with it is introspected
+func (c *IntrospectionClient) Revoke(token string) {
+	key := sha256.Sum256([]byte(token))
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	delete(c.cache, key)
+}
+
+// RevokeSession evicts all tokens of the session
+func (c *IntrospectionClient) RevokeSession(sessionID string) int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	evicted := 0
+	for k, e := range c.cache {
+		if e.resp.SessionId == sessionID {
+			delete(c.cache, k)
+			evicted++
+		}
+	}
+
+	return evicted
+}
+
+func (c *IntrospectionClient) introspect(ctx context.Context, token string) (*introspectionResponse, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// client_secret_basic, RFC 6749 section 2.3.1
+	req.SetBasicAuth(url.QueryEscape(c.cfg.ClientID), url.QueryEscape(c.cfg.ClientSecret))
+
+	resp, err := c.httpCli.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: introspection request: %v", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: introspection request: unexpected status %s", ErrUnavailable, resp.Status)
+	}
+
+	ir := &introspectionResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(ir); err != nil {
+		return nil, fmt.Errorf("%w: introspection response decode: %v", ErrUnavailable, err)
+	}
+
+	return ir, nil
+}
+
+func (c *IntrospectionClient) mapResponse(ir *introspectionResponse) *ValidateSessionResponse {
+	resp := &ValidateSessionResponse{
+		UserId:    ir.Sub,
+		SessionId: ir.Sid,
+	}
+	if resp.UserId == "" {
+		// client credentials tokens have no subject
+		resp.UserId = ir.ClientID
+	}
+
+	role := &Role{}
+	for _, scope := range strings.Fields(ir.Scope) {
+		perms, ok := c.cfg.ScopePermissions[scope]
+		if !ok {
+			perms = []string{scope}
+		}
+		for _, p := range perms {
+			role.Permissions = append(role.Permissions, &Permission{Name: p})
+		}
+	}
+	if len(role.Permissions) > 0 {
+		resp.Roles = append(resp.Roles, role)
+	}
+
+	return resp
+}
+
+// store caches the entry, expired entries are removed when the cache is full,
+// the entry expiring first gives place to the new one when none of them is expired
+func (c *IntrospectionClient) store(key [sha256.Size]byte, entry introspectionEntry) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if _, ok := c.cache[key]; !ok && len(c.cache) >= c.maxEntries {
+		now := c.now()
+		var first [sha256.Size]byte
+		var firstExpiresAt time.Time
+		for k, e := range c.cache {
+			if !now.Before(e.expiresAt) {
+				delete(c.cache, k)
+				continue
+			}
+			if firstExpiresAt.IsZero() || e.expiresAt.Before(firstExpiresAt) {
+				first, firstExpiresAt = k, e.expiresAt
+			}
+		}
+
+		if len(c.cache) >= c.maxEntries {
+			delete(c.cache, first)
+		}
+	}
+
+	c.cache[key] = entry
+}
@@ -0,0 +1,124 @@
+package extAuth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIntrospectionClient(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	exp := now.Add(time.Minute)
+	var calls int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "gateway" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		resp := map[string]interface{}{"active": false}
+		switch token := r.PostFormValue("token"); {
+		case token == "opaque-token":
+			resp = map[string]interface{}{
+				"active": true,
+				"sub":    "user-1",
+				"scope":  "orders payment:charge",
+				"exp":    exp.Unix(),
+			}
+		case token == "no-subject":
+			resp = map[string]interface{}{"active": true, "scope": "orders"}
+		case strings.HasPrefix(token, "client-"):
+			resp = map[string]interface{}{"active": true, "client_id": token, "exp": exp.Unix() + int64(len(token))}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	c := NewIntrospectionClient(IntrospectionConfig{
+		URL:              srv.URL,
+		ClientID:         "gateway",
+		ClientSecret:     "s3cret",
+		ScopePermissions: map[string][]string{"orders": {"orders:read", "orders:write"}},
+	})
+	c.now = func() time.Time { return now }
+
+	resp, err := c.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: "opaque-token"})
+	if err != nil {
+		t.Fatalf("ValidateSession() error = %v", err)
+	}
+	if resp.UserId != "user-1" || !resp.ExpiresAt.Equal(exp.Truncate(time.Second)) {
+		t.Errorf("ValidateSession() user = %q, expires at %v", resp.UserId, resp.ExpiresAt)
+	}
+
+	var perms []string
+	for _, p := range resp.Roles[0].Permissions {
+		perms = append(perms, p.Name)
+	}
+	if len(perms) != 3 || perms[0] != "orders:read" || perms[2] != "payment:charge" {
+		t.Errorf("ValidateSession() permissions = %v", perms)
+	}
+
+	if _, err := c.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: "opaque-token"}); err != nil {
+		t.Fatalf("ValidateSession() cached error = %v", err)
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("active response is not cached, calls = %d", calls)
+	}
+
+	c.Revoke("opaque-token")
+	if _, err := c.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: "opaque-token"}); err != nil {
+		t.Fatalf("ValidateSession() after revoke error = %v", err)
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("revoked token is served from cache, calls = %d", calls)
+	}
+
+	// cached response must not outlive the token
+	now = now.Add(2 * time.Minute)
+	if _, err := c.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: "opaque-token"}); err == nil {
+		t.Errorf("ValidateSession() accepted expired token")
+	}
+
+	if _, err := c.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: "revoked"}); err == nil {
+		t.Errorf("ValidateSession() accepted inactive token")
+	}
+
+	now = time.Unix(1700000000, 0)
+	if _, err := c.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: "no-subject"}); err == nil {
+		t.Errorf("ValidateSession() accepted active token without sub and client_id")
+	}
+
+	// the full cache gives place to new tokens, the token expiring first is evicted
+	c.cache = make(map[[sha256.Size]byte]introspectionEntry)
+	c.maxEntries = 2
+	validate := func(token string) {
+		t.Helper()
+		resp, err := c.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: token})
+		if err != nil || resp.UserId != token {
+			t.Fatalf("ValidateSession(%s) = %+v, %v", token, resp, err)
+		}
+	}
+	validate("client-a")
+	validate("client-bb")
+	validate("client-ccc")
+	atomic.StoreInt32(&calls, 0)
+	validate("client-bb")
+	validate("client-ccc")
+	if calls := atomic.LoadInt32(&calls); calls != 0 {
+		t.Errorf("new tokens are not cached when the cache is full, calls = %d", calls)
+	}
+	validate("client-a")
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("token expiring first is not evicted, calls = %d", calls)
+	}
+}
@@ -0,0 +1,445 @@
+package extAuth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"envoy.apiconf"
+	"google.golang.org/grpc"
+)
+
+const (
+	defaultJWKSRefreshInterval = 10 * time.Minute
+	// minimal pause between two JWKS reloads caused by an unknown "kid"
+	minJWKSRefreshInterval = 30 * time.Second
+)
+
+var (
+	errTokenMalformed = errors.New("malformed token")
+	errTokenSignature = errors.New("invalid token signature")
+	errTokenExpired   = errors.New("token is expired")
+)
+
+type (
+	JWTClaimsConf = apiconf.JWTClaimsConf
+	JWTConfig     = apiconf.JWTConfig
+)
+
+// JWTValidator validates tokens locally: the signature is checked against a JWKS
+// and the claims are mapped to the ValidateSession response, so no network call
+// is made per request.
+type JWTValidator struct {
+	cfg     JWTConfig
+	httpCli *http.Client
+	now     func() time.Time
+
+	mx          sync.RWMutex
+	keys        map[string]crypto.PublicKey
+	loadedAt    time.Time
+	lastAttempt time.Time
+}
+
+var _ AuthSessionServiceClient = &JWTValidator{}
+
+func NewJWTValidator(cfg JWTConfig) *JWTValidator {
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = defaultJWKSRefreshInterval
+	}
+	if cfg.Claims.UserID == "" {
+		cfg.Claims.UserID = "sub"
+	}
+	if cfg.Claims.SessionID == "" {
+		cfg.Claims.SessionID = "sid"
+	}
+	if cfg.Claims.Roles == "" {
+		cfg.Claims.Roles = "roles"
+	}
+	if cfg.Claims.Permissions == "" {
+		cfg.Claims.Permissions = "permissions"
+	}
+
+	return &JWTValidator{
+		cfg:     cfg,
+		httpCli: &http.Client{Timeout: 10 * time.Second},
+		now:     time.Now,
+	}
+}
+
+func (v *JWTValidator) ValidateSession(ctx context.Context, req *ValidateSessionRequest, _ ...grpc.CallOption) (
+	*ValidateSessionResponse, error) {
+	parts := strings.Split(req.SessionToken, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+
+	keys, err := v.keysFor(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range keys {
+		if verifySignature(header.Alg, k, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errTokenSignature
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return v.mapClaims(claims)
+}
+
+func (v *JWTValidator) checkClaims(claims map[string]interface{}) error {
+	now := v.now()
+
+	if exp, ok := claims["exp"].(float64); ok {
+		if now.After(time.Unix(int64(exp), 0).Add(v.cfg.Leeway)) {
+			return errTokenExpired
+		}
+	} else {
+		return fmt.Errorf("exp claim is required")
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok {
+		if now.Add(v.cfg.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return fmt.Errorf("token is not valid yet")
+		}
+	}
+
+	if v.cfg.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+			return fmt.Errorf("unexpected issuer %q", iss)
+		}
+	}
+
+	if len(v.cfg.Audience) > 0 {
+		matched := false
+		for _, aud := range stringList(claims["aud"]) {
+			for _, want := range v.cfg.Audience {
+				if aud == want {
+					matched = true
+				}
+			}
+		}
+		if !matched {
+			return fmt.Errorf("token audience does not match")
+		}
+	}
+
+	return nil
+}
+
+func (v *JWTValidator) mapClaims(claims map[string]interface{}) (*ValidateSessionResponse, error) {
+	userID, _ := claims[v.cfg.Claims.UserID].(string)
+	if userID == "" {
+		return nil, fmt.Errorf("claim %s is empty", v.cfg.Claims.UserID)
+	}
+
+	resp := &ValidateSessionResponse{UserId: userID}
+	resp.SessionId, _ = claims[v.cfg.Claims.SessionID].(string)
+
+	for _, name := range stringList(claims[v.cfg.Claims.Roles]) {
+		resp.Roles = append(resp.Roles, &Role{Name: name})
+	}
+
+	// permissions from the token are not tied to a particular role
+	if perms := stringList(claims[v.cfg.Claims.Permissions]); len(perms) > 0 {
+		role := &Role{}
+		for _, p := range perms {
+			role.Permissions = append(role.Permissions, &Permission{Name: p})
+		}
+		resp.Roles = append(resp.Roles, role)
+	}
+
+	return resp, nil
+}
+
+// keysFor returns candidate keys for the kid, reloading the JWKS when it is stale
+// or when the kid is unknown (keys rotation).
+func (v *JWTValidator) keysFor(ctx context.Context, kid string) ([]crypto.PublicKey, error) {
+	v.mx.RLock()
+	keys := v.lookup(kid)
+	stale := v.now().Sub(v.loadedAt) > v.cfg.RefreshInterval
+	canRetry := v.now().Sub(v.lastAttempt) > minJWKSRefreshInterval
+	v.mx.RUnlock()
+
+	if (stale || len(keys) == 0) && canRetry {
+		if err := v.refresh(ctx); err != nil && len(keys) == 0 {
+			return nil, err
+		}
+
+		v.mx.RLock()
+		keys = v.lookup(kid)
+		v.mx.RUnlock()
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	return keys, nil
+}
+
+func (v *JWTValidator) lookup(kid string) []crypto.PublicKey {
+	if kid != "" {
+		if k, ok := v.keys[kid]; ok {
+			return []crypto.PublicKey{k}
+		}
+		return nil
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(v.keys))
+	for _, k := range v.keys {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+func (v *JWTValidator) refresh(ctx context.Context) error {
+	v.mx.Lock()
+	v.lastAttempt = v.now()
+	v.mx.Unlock()
+
+	data, err := v.fetchJWKS(ctx)
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+
+	v.mx.Lock()
+	v.keys = keys
+	v.loadedAt = v.now()
+	v.mx.Unlock()
+
+	return nil
+}
+
+func (v *JWTValidator) fetchJWKS(ctx context.Context) ([]byte, error) {
+	if v.cfg.JWKSFile != "" {
+		data, err := os.ReadFile(v.cfg.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: read JWKS: %v", ErrUnavailable, err)
+		}
+
+		return data, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.cfg.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := v.httpCli.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: fetch JWKS: %v", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: fetch JWKS: unexpected status %s", ErrUnavailable, resp.Status)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%w: fetch JWKS: %v", ErrUnavailable, err)
+	}
+
+	return raw, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for i, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("parse JWKS key %q: %w", jwk.Kid, err)
+		}
+
+		kid := jwk.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("#%d", i)
+		}
+		keys[kid] = key
+	}
+
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid EC point")
+		}
+
+		return key, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 key size")
+		}
+
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+	}
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, sig []byte) bool {
+	switch alg {
+	case "RS256":
+		k, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		h := sha256.Sum256(signed)
+
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil
+	case "ES256":
+		k, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return false
+		}
+		h := sha256.Sum256(signed)
+
+		return ecdsa.Verify(k, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	case "EdDSA":
+		k, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+
+		return ed25519.Verify(k, signed, sig)
+	default:
+		// "none" and HMAC algorithms are never accepted
+		return false
+	}
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errTokenMalformed
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return errTokenMalformed
+	}
+
+	return nil
+}
+
+// stringList accepts a JSON string (space separated, like OAuth2 "scope") or an array of strings
+func stringList(v interface{}) []string {
+	switch val := v.(type) {
+	case string:
+		return strings.Fields(val)
+	case []interface{}:
+		res := make([]string, 0, len(val))
+		for _, item := range val {
+			if s, ok := item.(string); ok {
+				res = append(res, s)
+			}
+		}
+		return res
+	default:
+		return nil
+	}
+}
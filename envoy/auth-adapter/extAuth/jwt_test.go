@@ -0,0 +1,219 @@
+package extAuth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testSigner struct {
+	kid string
+	alg string
+	key crypto.Signer
+}
+
+func (s testSigner) jwk() map[string]string {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch k := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "kid": s.kid, "n": enc(k.N.Bytes()), "e": enc(big.NewInt(int64(k.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return map[string]string{"kty": "EC", "kid": s.kid, "crv": "P-256", "x": enc(k.X.FillBytes(make([]byte, 32))), "y": enc(k.Y.FillBytes(make([]byte, 32)))}
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "kid": s.kid, "crv": "Ed25519", "x": enc(k)}
+	}
+	return nil
+}
+
+func (s testSigner) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+
+	enc := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := enc(map[string]string{"alg": s.alg, "kid": s.kid, "typ": "JWT"}) + "." + enc(claims)
+
+	var (
+		sig []byte
+		err error
+	)
+	switch k := s.key.(type) {
+	case *rsa.PrivateKey:
+		h := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h[:])
+	case *ecdsa.PrivateKey:
+		h := sha256.Sum256([]byte(signed))
+		var r, ss *big.Int
+		r, ss, err = ecdsa.Sign(rand.Reader, k, h[:])
+		sig = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func newTestSigners(t *testing.T) []testSigner {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []testSigner{
+		{kid: "rsa", alg: "RS256", key: rsaKey},
+		{kid: "ec", alg: "ES256", key: ecKey},
+		{kid: "ed", alg: "EdDSA", key: edKey},
+	}
+}
+
+func jwksServer(t *testing.T, signers *atomic.Value, hits *int32) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		keys := []map[string]string{}
+		for _, s := range signers.Load().([]testSigner) {
+			keys = append(keys, s.jwk())
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestJWTValidator(t *testing.T) {
+	signers := newTestSigners(t)
+
+	published := &atomic.Value{}
+	published.Store(signers)
+	var hits int32
+	srv := jwksServer(t, published, &hits)
+
+	now := time.Unix(1700000000, 0)
+	v := NewJWTValidator(JWTConfig{
+		JWKSURL:  srv.URL,
+		Issuer:   "https://issuer.example",
+		Audience: []string{"api-gateway"},
+	})
+	v.now = func() time.Time { return now }
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":         "user-1",
+			"sid":         "session-1",
+			"iss":         "https://issuer.example",
+			"aud":         []string{"other", "api-gateway"},
+			"exp":         now.Add(time.Minute).Unix(),
+			"roles":       []string{"CLIENT"},
+			"permissions": "user:read user:write",
+		}
+		for k, val := range overrides {
+			if val == nil {
+				delete(c, k)
+				continue
+			}
+			c[k] = val
+		}
+		return c
+	}
+
+	for _, s := range signers {
+		t.Run(s.alg, func(t *testing.T) {
+			resp, err := v.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: s.sign(t, claims(nil))})
+			if err != nil {
+				t.Fatalf("ValidateSession() error = %v", err)
+			}
+			if resp.UserId != "user-1" || resp.SessionId != "session-1" {
+				t.Errorf("ValidateSession() user = %q, session = %q", resp.UserId, resp.SessionId)
+			}
+			if len(resp.Roles) != 2 || resp.Roles[0].Name != "CLIENT" || len(resp.Roles[1].Permissions) != 2 {
+				t.Errorf("ValidateSession() roles are not mapped: %+v", resp.Roles)
+			}
+		})
+	}
+
+	failures := []struct {
+		name   string
+		claims map[string]interface{}
+	}{
+		{name: "expired", claims: claims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})},
+		{name: "without exp", claims: claims(map[string]interface{}{"exp": nil})},
+		{name: "not yet valid", claims: claims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})},
+		{name: "wrong issuer", claims: claims(map[string]interface{}{"iss": "https://evil.example"})},
+		{name: "wrong audience", claims: claims(map[string]interface{}{"aud": "other"})},
+		{name: "without subject", claims: claims(map[string]interface{}{"sub": nil})},
+	}
+	for _, tt := range failures {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := v.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: signers[0].sign(t, tt.claims)})
+			if err == nil {
+				t.Errorf("ValidateSession() expected error")
+			}
+		})
+	}
+
+	t.Run("tampered payload", func(t *testing.T) {
+		token := signers[0].sign(t, claims(nil))
+		other := signers[0].sign(t, claims(map[string]interface{}{"sub": "admin"}))
+		forged := token[:len(token)-len(lastSegment(token))] + lastSegment(other)
+		if _, err := v.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: forged}); err == nil {
+			t.Errorf("ValidateSession() accepted forged signature")
+		}
+	})
+
+	t.Run("key rotation", func(t *testing.T) {
+		rotated := newTestSigners(t)
+		rotated[0].kid = "rsa-2"
+		published.Store(rotated)
+		now = now.Add(time.Minute) // let the unknown kid trigger a reload
+
+		before := atomic.LoadInt32(&hits)
+		if _, err := v.ValidateSession(context.Background(), &ValidateSessionRequest{SessionToken: rotated[0].sign(t, claims(nil))}); err != nil {
+			t.Fatalf("ValidateSession() with rotated key error = %v", err)
+		}
+		if atomic.LoadInt32(&hits) != before+1 {
+			t.Errorf("JWKS was not reloaded for the unknown kid")
+		}
+	})
+}
+
+func lastSegment(token string) string {
+	for i := len(token) - 1; i >= 0; i-- {
+		if token[i] == '.' {
+			return token[i+1:]
+		}
+	}
+	return token
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tel-io/tel/v2"
+)
+
+// watchFile polls the modification time of the file, the latest one of files for a directory,
+// and calls onChange when it is changed, it returns when done is closed
+func watchFile(file string, interval time.Duration, done <-chan struct{}, logger *tel.Telemetry, onChange func()) {
+	var modTime time.Time
+	if t, err := latestModTime(file); err == nil {
+		modTime = t
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			t, err := latestModTime(file)
+			if err != nil {
+				logger.Error("watch file stat", tel.String("file", file), tel.Error(err))
+				continue
+			}
+
+			if t.Equal(modTime) {
+				continue
+			}
+			modTime = t
+
+			onChange()
+		}
+	}
+}
+
+// latestModTime returns the modification time of the file or the latest one in the directory,
+// directories are included since removing a file changes only the time of its directory
+func latestModTime(file string) (time.Time, error) {
+	st, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !st.IsDir() {
+		return st.ModTime(), nil
+	}
+
+	var latest time.Time
+	err = filepath.WalkDir(file, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+
+		return nil
+	})
+
+	return latest, err
+}
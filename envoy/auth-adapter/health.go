@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/tel-io/tel/v2"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/health"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// authorizationService is the name envoy checks with grpc_health_check of the ext_auth cluster
+const authorizationService = "envoy.service.auth.v3.Authorization"
+
+// Validate checks the reCaptcha settings, the empty URL switches reCaptcha off
+func (rc *RCConf) Validate() error {
+	if rc.URL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(rc.URL)
+	if err != nil {
+		return fmt.Errorf("invalid RECAPTCHA_URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("invalid RECAPTCHA_URL %q: http(s) URL is expected", rc.URL)
+	}
+	if rc.SecretV2 == "" && rc.SecretV3 == "" {
+		return errors.New("RECAPTCHA_SECRET_V2 or RECAPTCHA_SECRET_V3 is required")
+	}
+	if rc.MinScore < 0 || rc.MinScore > 1 {
+		return fmt.Errorf("RECAPTCHA_MIN_SCORE must be between 0 and 1")
+	}
+
+	return nil
+}
+
+// readiness tells why the adapter can't serve requests: it is shutting down, the config is not loaded,
+// the auth backend is not reachable, reCaptcha is misconfigured or the rules use captcha providers which are not enabled
+func (s *server) readiness() error {
+	if s.draining.Load() {
+		return errors.New("shutting down")
+	}
+
+	if s.config() == nil {
+		return errors.New("config is not loaded")
+	}
+
+	if s.conn != nil {
+		switch state := s.conn.GetState(); state {
+		case connectivity.Ready:
+		case connectivity.Idle:
+			// idle connections are not dialed until the first call
+			s.conn.Connect()
+			return errors.New("auth backend is not connected yet")
+		default:
+			return fmt.Errorf("auth backend is not reachable: connection is %s", state)
+		}
+	}
+
+	if s.rcConfErr != nil {
+		return fmt.Errorf("recaptcha: %w", s.rcConfErr)
+	}
+
+	if err := s.captchaProvidersErr(s.config()); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// watchHealth sets the grpc.health.v1 status of the adapter and of the Authorization service
+// every interval until stop is closed, changes of the readiness are logged
+func (s *server) watchHealth(h *health.Server, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var prev error
+	first := true
+	for {
+		err := s.readiness()
+		if first || (err == nil) != (prev == nil) {
+			if err != nil {
+				s.logger.Warn("auth-adapter is not ready", tel.Error(err))
+			} else {
+				s.logger.Info("auth-adapter is ready")
+			}
+		}
+		first, prev = false, err
+
+		status := healthpb.HealthCheckResponse_SERVING
+		if err != nil {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		h.SetServingStatus("", status)
+		h.SetServingStatus(authorizationService, status)
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// handleReady is the HTTP readiness probe: GET /ready answers 503 with the reason when the adapter is not ready
+func (s *server) handleReady(w http.ResponseWriter, _ *http.Request) {
+	if err := s.readiness(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	fmt.Fprintln(w, "ok")
+}
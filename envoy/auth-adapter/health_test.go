@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tel-io/tel/v2"
+	"google.golang.org/grpc/health"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestRCConfValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    RCConf
+		wantErr bool
+	}{
+		{name: "switched off", conf: RCConf{}},
+		{name: "valid", conf: RCConf{URL: "https://www.google.com/recaptcha/api/siteverify", SecretV3: "secret"}},
+		{name: "no secrets", conf: RCConf{URL: "https://www.google.com/recaptcha/api/siteverify"}, wantErr: true},
+		{name: "relative url", conf: RCConf{URL: "/siteverify", SecretV2: "secret"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.conf.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWatchHealth(t *testing.T) {
+	logger := tel.NewNull()
+	cfg := loadTestConfig(t, `
+apis:
+  - name: Users
+    methods:
+      - name: Get
+        auth: {policy: no-need}
+`)
+
+	tests := []struct {
+		name      string
+		rcConfErr error
+		want      healthpb.HealthCheckResponse_ServingStatus
+	}{
+		{name: "ready", want: healthpb.HealthCheckResponse_SERVING},
+		{name: "invalid recaptcha", rcConfErr: errors.New("no secrets"), want: healthpb.HealthCheckResponse_NOT_SERVING},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{logger: &logger, rcConfErr: tt.rcConfErr}
+			s.authCfg.Store(cfg)
+
+			h := health.NewServer()
+			stop := make(chan struct{})
+			close(stop)
+			// the status is set before stop is checked
+			s.watchHealth(h, time.Hour, stop)
+
+			for _, service := range []string{"", authorizationService} {
+				resp, err := h.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.Status != tt.want {
+					t.Errorf("status of %q = %v, want %v", service, resp.Status, tt.want)
+				}
+			}
+		})
+	}
+}
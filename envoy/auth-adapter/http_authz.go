@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/tel-io/tel/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	envoy_service_auth_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+// headersToRemoveHeader lists the headers Envoy's http_service removes from the allowed request
+const headersToRemoveHeader = "x-envoy-auth-headers-to-remove"
+
+// httpAuthzPrefix is the path of the HTTP authorization endpoint, Envoy's http_service appends
+// the original path to it (path_prefix), nginx and Traefik pass it in headers
+const httpAuthzPrefix = "/authz"
+
+// httpAuthzHandler serves the HTTP authorization endpoint and the readiness probe
+func (s *server) httpAuthzHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(httpAuthzPrefix, s.handleHTTPCheck)
+	mux.HandleFunc(httpAuthzPrefix+"/", s.handleHTTPCheck)
+	mux.HandleFunc("/ready", s.handleReady)
+
+	return mux
+}
+
+// handleHTTPCheck runs Check for the original request: 200 with identity headers allows it,
+// the identity headers it doesn't set are listed in x-envoy-auth-headers-to-remove for Envoy;
+// the denial status, headers and message are returned otherwise
+func (s *server) handleHTTPCheck(w http.ResponseWriter, r *http.Request) {
+	resp, err := s.Check(r.Context(), httpCheckRequest(r))
+	if err != nil {
+		code := http.StatusInternalServerError
+		if status.Code(err) == codes.InvalidArgument {
+			code = http.StatusBadRequest
+		}
+		s.logger.Error("HTTP authorization check", tel.Error(err))
+		http.Error(w, status.Convert(err).Message(), code)
+		return
+	}
+
+	if denied := resp.GetDeniedResponse(); denied != nil {
+		for _, h := range denied.GetHeaders() {
+			w.Header().Add(h.GetHeader().GetKey(), h.GetHeader().GetValue())
+		}
+		http.Error(w, resp.GetStatus().GetMessage(), int(denied.GetStatus().GetCode()))
+		return
+	}
+
+	if remove := resp.GetOkResponse().GetHeadersToRemove(); len(remove) > 0 {
+		w.Header().Set(headersToRemoveHeader, strings.Join(remove, ","))
+	}
+	for _, h := range resp.GetOkResponse().GetHeaders() {
+		if h.GetAppend().GetValue() {
+			w.Header().Add(h.GetHeader().GetKey(), h.GetHeader().GetValue())
+		} else {
+			w.Header().Set(h.GetHeader().GetKey(), h.GetHeader().GetValue())
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// httpCheckRequest maps the authorization request to CheckRequest. The original method and URI are
+// taken from X-Forwarded-Method/X-Forwarded-Uri (Traefik), X-Original-Method/X-Original-URI (nginx)
+// or from the request itself without the endpoint prefix (Envoy). Header names are lowercased and
+// repeated headers are joined the way Envoy does it.
+func httpCheckRequest(r *http.Request) *envoy_service_auth_v3.CheckRequest {
+	method := firstHeader(r.Header, "X-Forwarded-Method", "X-Original-Method")
+	if method == "" {
+		method = r.Method
+	}
+
+	path := firstHeader(r.Header, "X-Forwarded-Uri", "X-Original-Uri")
+	if path == "" {
+		path = strings.TrimPrefix(r.URL.RequestURI(), httpAuthzPrefix)
+	}
+
+	host := firstHeader(r.Header, "X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		sep := ","
+		if name == "Cookie" {
+			sep = "; "
+		}
+		headers[strings.ToLower(name)] = strings.Join(values, sep)
+	}
+
+	return &envoy_service_auth_v3.CheckRequest{
+		Attributes: &envoy_service_auth_v3.AttributeContext{
+			Request: &envoy_service_auth_v3.AttributeContext_Request{
+				Http: &envoy_service_auth_v3.AttributeContext_HttpRequest{
+					Method:  method,
+					Path:    path,
+					Host:    host,
+					Headers: headers,
+				},
+			},
+		},
+	}
+}
+
+func firstHeader(h http.Header, names ...string) string {
+	for _, name := range names {
+		if v := h.Get(name); v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
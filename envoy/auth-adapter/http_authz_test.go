@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPAuthz(t *testing.T) {
+	cfg := loadTestConfig(t, `
+apis:
+  - name: Users
+    methods:
+      - name: Get
+        auth: {policy: no-need}
+      - name: Update
+        auth: {policy: required, permission: "write"}
+`)
+	handler := newTestServer(t, cfg).httpAuthzHandler()
+
+	tests := []struct {
+		name       string
+		target     string
+		headers    map[string]string
+		wantStatus int
+		wantUserID string
+	}{
+		{
+			name:       "envoy path prefix",
+			target:     "/authz/api/Users/Get",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "envoy without token",
+			target:     "/authz/api/Users/Update",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "traefik forward auth",
+			target:     "/authz",
+			headers:    map[string]string{"X-Forwarded-Method": "POST", "X-Forwarded-Uri": "/api/Users/Update", "Authorization": "Bearer demo-token"},
+			wantStatus: http.StatusOK,
+			wantUserID: "demo-user-123",
+		},
+		{
+			name:       "nginx auth request",
+			target:     "/authz",
+			headers:    map[string]string{"X-Original-Method": "POST", "X-Original-URI": "/api/Users/Update", "Authorization": "Bearer demo-token"},
+			wantStatus: http.StatusOK,
+			wantUserID: "demo-user-123",
+		},
+		{
+			name:       "nginx without token",
+			target:     "/authz",
+			headers:    map[string]string{"X-Original-URI": "/api/Users/Update"},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if got := rec.Header().Get("user-id"); got != tt.wantUserID {
+				t.Errorf("user-id = %q, want %q", got, tt.wantUserID)
+			}
+		})
+	}
+
+	// Envoy removes identity headers sent by the client which the adapter doesn't set
+	req := httptest.NewRequest(http.MethodGet, "/authz/api/Users/Get", nil)
+	req.Header.Set("client-id", "billing")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get(headersToRemoveHeader); got != "user-id,session-id,client-id,service-id" {
+		t.Errorf("%s = %q, want all identity headers", headersToRemoveHeader, got)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+
+	"envoy.apiconf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// listenAuthz opens the listener of an authorization server, a stale unix socket file is removed
+func listenAuthz(listen string) (net.Listener, error) {
+	if path, ok := apiconf.ListenSocket(listen); ok {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+
+		return net.Listen("unix", path)
+	}
+
+	return net.Listen("tcp", listen)
+}
+
+// serverCredentials returns TLS credentials of the ext_authz gRPC server, nil for plaintext
+func serverCredentials(conf *apiconf.AuthAdapterTLSConf) (grpc.ServerOption, error) {
+	tlsConf, err := serverTLSConfig(conf)
+	if tlsConf == nil || err != nil {
+		return nil, err
+	}
+
+	return grpc.Creds(credentials.NewTLS(tlsConf)), nil
+}
+
+// serverTLSConfig is shared by the gRPC and HTTP authorization servers, nil for plaintext
+func serverTLSConfig(conf *apiconf.AuthAdapterTLSConf) (*tls.Config, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load server certificate: %w", err)
+	}
+
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if conf.MTLS() {
+		pem, err := os.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client CA file %s", conf.ClientCAFile)
+		}
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConf, nil
+}
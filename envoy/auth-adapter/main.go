@@ -1,32 +1,86 @@
 package main
 
 import (
-	"net"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
+	"envoy.apiconf"
 	grpcx "github.com/tel-io/instrumentation/middleware/grpc"
 	"github.com/tel-io/tel/v2"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/health"
 
 	envoy_service_auth_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
-func parseRCConf() *RCConf {
+func parseRCConf() (*RCConf, error) {
 	rcConf := &RCConf{}
 
 	rcConf.URL = os.Getenv("RECAPTCHA_URL")
 	rcConf.SecretV2 = os.Getenv("RECAPTCHA_SECRET_V2")
 	rcConf.SecretV3 = os.Getenv("RECAPTCHA_SECRET_V3")
-	rcConf.MinScore = 0.5 //FIXME should be configurable?
+	rcConf.HCaptchaSecret = os.Getenv("HCAPTCHA_SECRET")
+	rcConf.TurnstileSecret = os.Getenv("TURNSTILE_SECRET")
 
-	return rcConf
+	minScore, err := strconv.ParseFloat(getEnvVar("RECAPTCHA_MIN_SCORE", "0.5"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RECAPTCHA_MIN_SCORE: %w", err)
+	}
+	rcConf.MinScore = minScore
+
+	return rcConf, nil
+}
+
+var (
+	configPath           string
+	configReloadInterval time.Duration
+	healthCheckInterval  time.Duration
+	drainDelay           time.Duration
+	shutdownTimeout      time.Duration
+)
+
+func init() {
+	flag.StringVar(&configPath, "config", getEnvVar("AUTH_ADAPTER_CONFIG", "/opt/auth-adapter/config.yaml"),
+		"auth config file path")
+	flag.DurationVar(&configReloadInterval, "config-reload-interval", 10*time.Second,
+		"how often the config file is checked for changes")
+	flag.DurationVar(&healthCheckInterval, "health-check-interval", 5*time.Second,
+		"how often the readiness of the adapter is checked for the gRPC health service")
+	flag.DurationVar(&drainDelay, "drain-delay", 10*time.Second,
+		"how long NOT_SERVING is reported on shutdown before the gRPC server stops accepting requests")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 20*time.Second,
+		"deadline of in-flight checks on shutdown, the remaining ones are cancelled")
+}
+
+// reloadConfig applies the changed config, a broken config is logged and the previous one is kept
+func reloadConfig(logg *tel.Telemetry, s *server) {
+	authCfg, err := LoadConfig(configPath)
+	if err != nil {
+		logg.Error("config reload failed, previous config is kept", tel.String("file", configPath), tel.Error(err))
+		return
+	}
+
+	if err := s.Reload(authCfg); err != nil {
+		logg.Error("config reload failed, previous config is kept", tel.String("file", configPath), tel.Error(err))
+		return
+	}
+
+	logg.Info("config is reloaded", tel.String("file", configPath))
 }
 
 func main() {
+	flag.Parse()
+
 	logg, closer := tel.New(context.Background(), tel.GetConfigFromEnv())
 	defer closer()
 
@@ -37,38 +91,157 @@ func main() {
 	signal.Notify(sigs, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
 	// load auth config
-	authCfg, err := LoadConfig("/opt/auth-adapter/config.yaml")
+	authCfg, err := LoadConfig(configPath)
 	if err != nil {
 		panic(err)
 	}
 
-	grpcServer := grpc.NewServer(
+	serverOpts := []grpc.ServerOption{
 		grpc.ChainUnaryInterceptor(grpcx.UnaryServerInterceptor()),
-	)
+	}
+	creds, err := serverCredentials(authCfg.AuthAdapter.GetTLS())
+	if err != nil {
+		panic(err)
+	}
+	if creds != nil {
+		serverOpts = append(serverOpts, creds)
+	}
+	grpcServer := grpc.NewServer(serverOpts...)
+
+	// the adapter is not serving until the readiness checks pass
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	stopHealth := make(chan struct{})
 
+	listener, err := listenAuthz(authCfg.AuthAdapter.GetListen())
+	if err != nil {
+		grpclog.Fatalf("failed to listen: %v", err)
+	}
+
+	rcConf, err := parseRCConf()
+	if err != nil {
+		panic(err)
+	}
+
+	s, err := NewServer(&logg, os.Getenv("AUTH_SERVICE_ADDR"), authCfg, rcConf)
+	if err != nil {
+		panic(err)
+	}
+
+	envoy_service_auth_v3.RegisterAuthorizationServer(grpcServer, s)
+	go s.watchHealth(healthServer, healthCheckInterval, stopHealth)
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
 	go func() {
-		listener, err := net.Listen("tcp", ":9000")
-		if err != nil {
-			grpclog.Fatalf("failed to listen: %v", err)
+		for range reloads {
+			reloadConfig(&logg, s)
 		}
-
-		s, err := NewServer(&logg, os.Getenv("AUTH_SERVICE_ADDR"), authCfg, parseRCConf())
+	}()
+	// file changes go through the same channel so reloads never run concurrently
+	go watchFile(configPath, configReloadInterval, nil, &logg, func() {
+		reloads <- syscall.SIGHUP
+	})
+
+	adminServer := &http.Server{Addr: getEnvVar("ADMIN_ADDR", "127.0.0.1:9001"), Handler: s.adminHandler()}
+	go serveHTTP(&logg, "admin", adminServer)
+
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", s.metrics.Handler())
+	metricsServer := &http.Server{Addr: getEnvVar("METRICS_ADDR", ":9102"), Handler: metricsMux}
+	go serveHTTP(&logg, "metrics", metricsServer)
+
+	httpServers := []*http.Server{adminServer, metricsServer}
+	if httpListen := authCfg.AuthAdapter.GetHTTPListen(); httpListen != "" {
+		authzServer, err := serveHTTPAuthz(&logg, s, httpListen, authCfg.AuthAdapter.GetTLS())
 		if err != nil {
 			panic(err)
 		}
+		httpServers = append(httpServers, authzServer)
+	}
 
-		envoy_service_auth_v3.RegisterAuthorizationServer(grpcServer, s)
-
-		logg.Info("gRPC service started at :9000")
-		err = grpcServer.Serve(listener)
-		if err != nil {
+	go func() {
+		logg.Info("gRPC service started at "+authCfg.AuthAdapter.GetListen(),
+			tel.Bool("tls", creds != nil))
+		if err := grpcServer.Serve(listener); err != nil {
 			panic(err)
 		}
 	}()
 
 	<-sigs
 	logg.Info("stopping...")
-	grpcServer.Stop()
+
+	// envoy stops sending checks after its health checks see NOT_SERVING
+	s.draining.Store(true)
+	close(stopHealth)
+	healthServer.Shutdown()
+	logg.Info("draining", tel.Duration("delay", drainDelay))
+	time.Sleep(drainDelay)
+
+	stopGRPC(&logg, grpcServer, shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range httpServers {
+		if err := srv.Shutdown(ctx); err != nil {
+			logg.Error("HTTP service shutdown", tel.String("addr", srv.Addr), tel.Error(err))
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		logg.Error("auth backend connection close", tel.Error(err))
+	}
 
 	logg.Info("done.")
 }
+
+func serveHTTP(logg *tel.Telemetry, name string, srv *http.Server) {
+	logg.Info(name + " HTTP service started at " + srv.Addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logg.Error(name+" HTTP service", tel.Error(err))
+	}
+}
+
+// serveHTTPAuthz starts the HTTP authorization endpoint with the TLS settings of the gRPC server
+func serveHTTPAuthz(logg *tel.Telemetry, s *server, listen string, tlsConf *apiconf.AuthAdapterTLSConf) (*http.Server, error) {
+	listener, err := listenAuthz(listen)
+	if err != nil {
+		return nil, err
+	}
+
+	srvTLS, err := serverTLSConfig(tlsConf)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if srvTLS != nil {
+		listener = tls.NewListener(listener, srvTLS)
+	}
+
+	srv := &http.Server{Handler: s.httpAuthzHandler(), TLSConfig: srvTLS}
+	go func() {
+		logg.Info("HTTP authorization service started at "+listen, tel.Bool("tls", srvTLS != nil))
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logg.Error("HTTP authorization service", tel.Error(err))
+		}
+	}()
+
+	return srv, nil
+}
+
+// stopGRPC waits for in-flight calls within the timeout, the remaining calls are cancelled
+func stopGRPC(logg *tel.Telemetry, grpcServer *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		logg.Warn("in-flight checks are not finished in time, cancelling them", tel.Duration("timeout", timeout))
+		grpcServer.Stop()
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"envoy.apiconf"
+	"envoy.auth/extAuth"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// adapterMetrics are served in the Prometheus format, labels never take values from request paths
+// which don't match the config, so their cardinality is bounded by the config
+type adapterMetrics struct {
+	registry *prometheus.Registry
+
+	checks             *prometheus.CounterVec
+	checkDuration      *prometheus.HistogramVec
+	validateDuration   *prometheus.HistogramVec
+	rateLimitHits      *prometheus.CounterVec
+	recaptcha          *prometheus.CounterVec
+	cacheLookups       *prometheus.CounterVec
+	breakerTransitions *prometheus.CounterVec
+	shadowDenials      *prometheus.CounterVec
+}
+
+func newAdapterMetrics() (*adapterMetrics, error) {
+	m := &adapterMetrics{
+		registry: prometheus.NewRegistry(),
+
+		checks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_checks_total",
+			Help: "authorization checks by the matched rule and decision",
+		}, []string{"service", "method", "policy", "decision"}),
+		checkDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "auth_check_duration_seconds",
+			Help:    "duration of authorization checks",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"service", "method", "policy", "decision"}),
+		validateDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "auth_validate_session_duration_seconds",
+			Help:    "duration of ValidateSession calls by token validator and result",
+			Buckets: prometheus.ExponentialBuckets(0.0005, 2, 14),
+		}, []string{"validator", "result"}),
+		rateLimitHits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_rate_limit_hits_total",
+			Help: "requests over rate limits, limit is ip for method limits and client for api key tiers",
+		}, []string{"method", "limit", "mode"}),
+		recaptcha: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_recaptcha_verifications_total",
+			Help: "captcha verifications by provider, version (v2 for challenge tokens) and result",
+		}, []string{"provider", "version", "result"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_session_cache_lookups_total",
+			Help: "session cache lookups by token validator and result (hit or miss)",
+		}, []string{"validator", "result"}),
+		breakerTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_backend_breaker_transitions_total",
+			Help: "circuit breaker state transitions of auth backends",
+		}, []string{"backend", "from", "to"}),
+		shadowDenials: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_shadow_denials_total",
+			Help: "requests shadow rules would deny, by rule and reason",
+		}, []string{"rule", "reason", "status"}),
+	}
+
+	for _, c := range []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.checks, m.checkDuration, m.validateDuration, m.rateLimitHits, m.recaptcha, m.cacheLookups,
+		m.breakerTransitions, m.shadowDenials,
+	} {
+		if err := m.registry.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// Handler serves the metrics to Prometheus
+func (m *adapterMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// WatchRateLimiter exports the number of IPs and clients the rate limiter keeps counters for
+func (m *adapterMetrics) WatchRateLimiter(rlm *RateLimitManager) error {
+	ips := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "auth_rate_limit_tracked_ips",
+		Help: "client IPs with rate limit counters, summed over methods",
+	}, func() float64 {
+		ips, _ := rlm.Size()
+		return float64(ips)
+	})
+	clients := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "auth_rate_limit_tracked_clients",
+		Help: "api key clients with rate limit counters",
+	}, func() float64 {
+		_, clients := rlm.Size()
+		return float64(clients)
+	})
+
+	if err := m.registry.Register(ips); err != nil {
+		return err
+	}
+
+	return m.registry.Register(clients)
+}
+
+// WatchSessionCache counts lookups of the cache and exports its size
+func (m *adapterMetrics) WatchSessionCache(validator string, cache *extAuth.SessionCache) error {
+	cache.OnLookup = func(hit bool) {
+		result := "miss"
+		if hit {
+			result = "hit"
+		}
+		m.cacheLookups.WithLabelValues(validator, result).Inc()
+	}
+
+	return m.registry.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "auth_session_cache_entries",
+		Help:        "entries of the session cache",
+		ConstLabels: prometheus.Labels{"validator": validator},
+	}, func() float64 {
+		return float64(cache.Len())
+	}))
+}
+
+func (m *adapterMetrics) Check(service, method, policy, decision string, d time.Duration) {
+	m.checks.WithLabelValues(service, method, policy, decision).Inc()
+	m.checkDuration.WithLabelValues(service, method, policy, decision).Observe(d.Seconds())
+}
+
+func (m *adapterMetrics) ValidateSession(validator, result string, d time.Duration) {
+	m.validateDuration.WithLabelValues(validator, result).Observe(d.Seconds())
+}
+
+func (m *adapterMetrics) RateLimitHit(method, limit string, shadow bool) {
+	mode := apiconf.ModeEnforce
+	if shadow {
+		mode = apiconf.ModeShadow
+	}
+	m.rateLimitHits.WithLabelValues(method, limit, mode).Inc()
+}
+
+func (m *adapterMetrics) Recaptcha(provider string, v2 bool, result string) {
+	version := "v3"
+	if v2 {
+		version = "v2"
+	}
+	m.recaptcha.WithLabelValues(provider, version, result).Inc()
+}
+
+func (m *adapterMetrics) BreakerTransition(backend, from, to string) {
+	m.breakerTransitions.WithLabelValues(backend, from, to).Inc()
+}
+
+func (m *adapterMetrics) ShadowDenial(rule, reason string, code int) {
+	m.shadowDenials.WithLabelValues(rule, reason, strconv.Itoa(code)).Inc()
+}
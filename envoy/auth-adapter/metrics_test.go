@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	cfg := loadTestConfig(t, `
+apis:
+  - name: Users
+    methods:
+      - name: Get
+        auth: {policy: no-need, rate_limit: {period: 1m, count: 1}}
+`)
+	s := newTestServer(t, cfg)
+	s.captchaVerifiers = unreachableRecaptcha()
+	metrics := s.metrics
+	if err := metrics.WatchRateLimiter(s.rateLimitManager); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := map[string]string{"x-real-ip": "10.0.0.1"}
+	for _, path := range []string{"/api/Users/Get", "/api/Users/Get", "/api/Unknown/42"} {
+		if _, err := s.Check(context.Background(), checkRequest(path, headers)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := io.ReadAll(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		`auth_checks_total{decision="allow",method="Get",policy="no-need",service="Users"} 1`,
+		`auth_rate_limit_hits_total{limit="ip",method="Users/Get",mode="enforce"} 1`,
+		`auth_recaptcha_verifications_total{provider="recaptcha",result="missing",version="v2"} 1`,
+		`auth_rate_limit_tracked_ips 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("%s is not found", want)
+		}
+	}
+	if strings.Contains(string(body), "Unknown") {
+		t.Error("unknown path is used as a label")
+	}
+}
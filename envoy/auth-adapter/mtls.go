@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+
+	"envoy.apiconf"
+	envoy_service_auth_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+)
+
+type mtlsIdentities struct {
+	bySAN     map[string]*apiconf.MTLSIdentityConf
+	bySubject map[string]*apiconf.MTLSIdentityConf
+}
+
+func newMTLSIdentities(conf []*apiconf.MTLSIdentityConf) (*mtlsIdentities, error) {
+	ids := &mtlsIdentities{
+		bySAN:     make(map[string]*apiconf.MTLSIdentityConf),
+		bySubject: make(map[string]*apiconf.MTLSIdentityConf),
+	}
+
+	for _, c := range conf {
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+
+		idx, key := ids.bySAN, c.SAN
+		if c.Subject != "" {
+			idx, key = ids.bySubject, c.Subject
+		}
+		if _, ok := idx[key]; ok {
+			return nil, fmt.Errorf("identity %s is already configured", key)
+		}
+		idx[key] = c
+	}
+
+	return ids, nil
+}
+
+// Resolve finds the identity of the peer. Envoy passes the principal (URI SAN or subject)
+// and, with include_peer_certificate, the URL encoded PEM of the certificate.
+func (ids *mtlsIdentities) Resolve(peer *envoy_service_auth_v3.AttributeContext_Peer) (*apiconf.MTLSIdentityConf, error) {
+	if peer == nil || (peer.Principal == "" && peer.Certificate == "") {
+		return nil, fmt.Errorf("client certificate is not presented")
+	}
+
+	if peer.Certificate != "" {
+		cert, err := parsePeerCertificate(peer.Certificate)
+		if err != nil {
+			return nil, err
+		}
+
+		sans := cert.DNSNames
+		for _, u := range cert.URIs {
+			sans = append(sans, u.String())
+		}
+		for _, san := range sans {
+			if id, ok := ids.bySAN[san]; ok {
+				return id, nil
+			}
+		}
+
+		if id, ok := ids.bySubject[cert.Subject.String()]; ok {
+			return id, nil
+		}
+	}
+
+	if id, ok := ids.bySAN[peer.Principal]; ok {
+		return id, nil
+	}
+	if id, ok := ids.bySubject[peer.Principal]; ok {
+		return id, nil
+	}
+
+	return nil, fmt.Errorf("unknown client certificate %s", peer.Principal)
+}
+
+func parsePeerCertificate(raw string) (*x509.Certificate, error) {
+	data, err := url.QueryUnescape(raw)
+	if err != nil {
+		return nil, fmt.Errorf("decode client certificate: %w", err)
+	}
+
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("client certificate is not PEM encoded")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"envoy.apiconf"
+	envoy_service_auth_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+func TestMTLSIdentitiesResolve(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spiffe, _ := url.Parse("spiffe://cluster.local/ns/billing/sa/default")
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "billing", Organization: []string{"corp"}},
+		URIs:         []*url.URL{spiffe},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := url.QueryEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+
+	ids, err := newMTLSIdentities([]*apiconf.MTLSIdentityConf{
+		{Service: "billing", SAN: "spiffe://cluster.local/ns/billing/sa/default"},
+		{Service: "reports", Subject: "CN=reports,O=corp"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		peer        *envoy_service_auth_v3.AttributeContext_Peer
+		wantService string
+	}{
+		{name: "certificate SAN", peer: &envoy_service_auth_v3.AttributeContext_Peer{Certificate: certPEM}, wantService: "billing"},
+		{name: "principal subject", peer: &envoy_service_auth_v3.AttributeContext_Peer{Principal: "CN=reports,O=corp"}, wantService: "reports"},
+		{name: "unknown principal", peer: &envoy_service_auth_v3.AttributeContext_Peer{Principal: "CN=evil"}},
+		{name: "no certificate", peer: &envoy_service_auth_v3.AttributeContext_Peer{}},
+		{name: "no peer"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := ids.Resolve(tt.peer)
+			if tt.wantService == "" {
+				if err == nil {
+					t.Errorf("Resolve() = %s, want error", id.Service)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			if id.Service != tt.wantService {
+				t.Errorf("Resolve() = %s, want %s", id.Service, tt.wantService)
+			}
+		})
+	}
+}
+
+func TestCheckMTLS(t *testing.T) {
+	cfg := loadTestConfig(t, `
+mtls_identities:
+  - service: billing
+    san: spiffe://cluster.local/ns/billing/sa/default
+    permissions: [ledger:write]
+apis:
+  - name: Ledger
+    methods:
+      - name: Append
+        auth: {policy: mtls, permission: ledger:write}
+      - name: Close
+        auth: {policy: mtls, permission: ledger:admin}
+      - name: Read
+        auth: {policy: mtls, permission: ledger:write, mode: shadow}
+`)
+	s := newTestServer(t, cfg)
+
+	tests := []struct {
+		name          string
+		path          string
+		principal     string
+		want          v3.StatusCode
+		wantServiceID string
+	}{
+		{name: "unknown san", path: "/api/Ledger/Append", principal: "spiffe://cluster.local/ns/evil/sa/default",
+			want: v3.StatusCode_Unauthorized},
+		{name: "no certificate", path: "/api/Ledger/Append", want: v3.StatusCode_Unauthorized},
+		{name: "without permission", path: "/api/Ledger/Close", principal: "spiffe://cluster.local/ns/billing/sa/default",
+			want: v3.StatusCode_Forbidden},
+		{name: "allowed", path: "/api/Ledger/Append", principal: "spiffe://cluster.local/ns/billing/sa/default",
+			wantServiceID: "billing"},
+		{name: "shadow unknown san", path: "/api/Ledger/Read", principal: "spiffe://cluster.local/ns/evil/sa/default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := checkRequest(tt.path, map[string]string{"service-id": "billing"})
+			req.Attributes.Source = &envoy_service_auth_v3.AttributeContext_Peer{Principal: tt.principal}
+			resp, err := s.Check(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got v3.StatusCode
+			if denied := resp.GetDeniedResponse(); denied != nil {
+				got = denied.Status.Code
+			}
+			if got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+			if serviceID := responseHeader(resp, "service-id"); serviceID != tt.wantServiceID {
+				t.Errorf("service-id = %q, want %q", serviceID, tt.wantServiceID)
+			}
+			// the service-id sent by the caller doesn't reach the upstream
+			if tt.want == 0 && tt.wantServiceID == "" && !removesHeader(resp, "service-id") {
+				t.Errorf("service-id is not removed")
+			}
+		})
+	}
+}
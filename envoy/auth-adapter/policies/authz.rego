@@ -0,0 +1,16 @@
+package authz
+
+import future.keywords.if
+import future.keywords.in
+
+# decision of the auth-adapter: allow, status and message of denied requests,
+# headers added to the request
+decision := {"allow": false, "status": 403, "message": "admin API is available from the office network only"} if {
+	input.service in data.admin_services
+	not from_office
+} else := {"allow": true, "headers": {"x-user-roles": concat(",", input.user.roles)}}
+
+from_office if {
+	some cidr in data.office_networks
+	net.cidr_contains(cidr, input.request.source_ip)
+}
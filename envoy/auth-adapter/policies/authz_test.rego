@@ -0,0 +1,35 @@
+package authz
+
+import future.keywords.if
+
+test_admin_from_office if {
+	decision.allow with input as {
+		"service": "AdminService",
+		"request": {"source_ip": "10.1.2.3"},
+		"user": {"roles": ["ADMIN"]},
+	}
+}
+
+test_admin_from_outside_denied if {
+	d := decision with input as {
+		"service": "AdminService",
+		"request": {"source_ip": "203.0.113.7"},
+		"user": {"roles": ["ADMIN"]},
+	}
+	not d.allow
+	d.status == 403
+}
+
+test_admin_without_source_ip_denied if {
+	not decision.allow with input as {"service": "AdminService", "request": {}, "user": {"roles": ["ADMIN"]}}
+}
+
+test_roles_header if {
+	d := decision with input as {
+		"service": "UserService",
+		"request": {"source_ip": "203.0.113.7"},
+		"user": {"roles": ["CLIENT", "ADMIN"]},
+	}
+	d.allow
+	d.headers["x-user-roles"] == "CLIENT,ADMIN"
+}
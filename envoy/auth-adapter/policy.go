@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"envoy.apiconf"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/open-policy-agent/opa/rego"
+	"github.com/tel-io/tel/v2"
+
+	envoy_api_v3_core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+const defaultPolicyReloadInterval = 10 * time.Second
+
+// policyInput is the input document of the policy query
+type policyInput struct {
+	Request policyRequest `json:"request"`
+	Service string        `json:"service"`
+	Method  string        `json:"method"`
+	Rule    policyRule    `json:"rule"`
+	User    *policyUser   `json:"user"`
+}
+
+type policyRequest struct {
+	Path     string            `json:"path"`
+	Method   string            `json:"method"` // HTTP verb
+	Headers  map[string]string `json:"headers"`
+	SourceIP string            `json:"source_ip"` // peer address of Envoy downstream connection
+	ClientIP string            `json:"client_ip"` // x-real-ip or x-forwarded-for
+}
+
+type policyRule struct {
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+	Policy     string `json:"policy"`
+	Permission string `json:"permission"`
+}
+
+type policyUser struct {
+	ID          string   `json:"id"`
+	SessionID   string   `json:"session_id"`
+	Roles       []string `json:"roles"`
+	Permissions []string `json:"permissions"`
+}
+
+// policyDecision is the result of the policy query, the query returns either a boolean
+// or an object like {"allow": false, "status": 403, "message": "...", "headers": {...}}
+type policyDecision struct {
+	Allow   bool              `json:"allow"`
+	Status  int               `json:"status"`
+	Message string            `json:"message"`
+	Headers map[string]string `json:"headers"`
+}
+
+// StatusCode is the status of denied requests, 403 unless the policy sets an error status
+func (d *policyDecision) StatusCode() v3.StatusCode {
+	if d.Status < 400 || d.Status > 599 {
+		return v3.StatusCode_Forbidden
+	}
+
+	return v3.StatusCode(d.Status)
+}
+
+// ResponseHeaders are the headers set by the policy, added to the request or to the denied response
+func (d *policyDecision) ResponseHeaders() []*envoy_api_v3_core.HeaderValueOption {
+	res := make([]*envoy_api_v3_core.HeaderValueOption, 0, len(d.Headers))
+	for k, v := range d.Headers {
+		res = append(res, &envoy_api_v3_core.HeaderValueOption{
+			Header: &envoy_api_v3_core.HeaderValue{Key: strings.ToLower(k), Value: v},
+			Append: &wrappers.BoolValue{Value: false},
+		})
+	}
+
+	return res
+}
+
+// PolicyEngine evaluates Rego policies of the bundle directory, the policies are compiled again
+// when files of the directory are changed
+type PolicyEngine struct {
+	conf   *apiconf.PolicyEngineConf
+	logger *tel.Telemetry
+
+	query atomic.Pointer[rego.PreparedEvalQuery]
+
+	done chan struct{}
+}
+
+func NewPolicyEngine(conf *apiconf.PolicyEngineConf, logger *tel.Telemetry) (*PolicyEngine, error) {
+	e := &PolicyEngine{
+		conf:   conf,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+
+	interval := conf.ReloadInterval
+	if interval == 0 {
+		interval = defaultPolicyReloadInterval
+	}
+	go watchFile(conf.Bundle, interval, e.done, logger, func() {
+		// keep evaluating the previous policies if the new ones don't compile
+		if err := e.load(); err != nil {
+			logger.Error("policies reload failed", tel.String("bundle", conf.Bundle), tel.Error(err))
+		}
+	})
+
+	return e, nil
+}
+
+// Evaluate runs the policy query, an undefined result denies the request
+func (e *PolicyEngine) Evaluate(ctx context.Context, input *policyInput) (*policyDecision, error) {
+	rs, err := e.query.Load().Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rs) == 0 || len(rs[0].Expressions) == 0 {
+		return &policyDecision{Message: "policy decision is undefined"}, nil
+	}
+
+	return parseDecision(rs[0].Expressions[0].Value)
+}
+
+func (e *PolicyEngine) Close() {
+	close(e.done)
+}
+
+func (e *PolicyEngine) load() error {
+	query, err := rego.New(
+		rego.Query(e.conf.GetQuery()),
+		rego.Load([]string{e.conf.Bundle}, skipPolicyTests),
+	).PrepareForEval(context.Background())
+	if err != nil {
+		return err
+	}
+
+	e.query.Store(&query)
+	e.logger.Info("policies loaded", tel.String("bundle", e.conf.Bundle), tel.String("query", e.conf.GetQuery()))
+
+	return nil
+}
+
+// skipPolicyTests excludes unit tests of policies, they are run by opa test or go test
+func skipPolicyTests(_ string, info fs.FileInfo, _ int) bool {
+	return !info.IsDir() && strings.HasSuffix(info.Name(), "_test.rego")
+}
+
+func parseDecision(v interface{}) (*policyDecision, error) {
+	if allow, ok := v.(bool); ok {
+		return &policyDecision{Allow: allow}, nil
+	}
+
+	if _, ok := v.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("policy decision must be a boolean or an object, got %T", v)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var d policyDecision
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, fmt.Errorf("invalid policy decision: %w", err)
+	}
+
+	return &d, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"envoy.apiconf"
+	"github.com/open-policy-agent/opa/tester"
+	"github.com/tel-io/tel/v2"
+
+	v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+// TestPolicies runs unit tests of the example policies, test rules are named test_*
+func TestPolicies(t *testing.T) {
+	results, err := tester.Run(context.Background(), "policies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) == 0 {
+		t.Fatal("no policy tests found")
+	}
+
+	for _, r := range results {
+		if r.Fail || r.Error != nil {
+			t.Errorf("%s.%s failed: %v", r.Package, r.Name, r.Error)
+		}
+	}
+}
+
+func TestPolicyEngine(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "authz.rego")
+	err := os.WriteFile(file, []byte(`
+package authz
+
+default decision := false
+
+decision := true {
+	input.user.roles[_] == "ADMIN"
+}
+
+decision := {"allow": false, "status": 429, "message": "slow down", "headers": {"Retry-After": "10"}} {
+	input.request.headers["x-flood"] == "1"
+}
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := tel.NewNull()
+	engine, err := NewPolicyEngine(&apiconf.PolicyEngineConf{Bundle: dir}, &logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	tests := []struct {
+		name    string
+		input   *policyInput
+		allow   bool
+		status  v3.StatusCode
+		headers int
+	}{
+		{name: "boolean allow", input: &policyInput{User: &policyUser{Roles: []string{"ADMIN"}}}, allow: true},
+		{name: "boolean deny", input: &policyInput{User: &policyUser{Roles: []string{"CLIENT"}}}, status: v3.StatusCode_Forbidden},
+		{name: "object deny", input: &policyInput{
+			Request: policyRequest{Headers: map[string]string{"x-flood": "1"}},
+			User:    &policyUser{},
+		}, status: v3.StatusCode_TooManyRequests, headers: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := engine.Evaluate(context.Background(), tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Allow != tt.allow {
+				t.Fatalf("allow = %v, want %v", d.Allow, tt.allow)
+			}
+			if !d.Allow && d.StatusCode() != tt.status {
+				t.Errorf("status = %v, want %v", d.StatusCode(), tt.status)
+			}
+			if headers := d.ResponseHeaders(); len(headers) != tt.headers {
+				t.Errorf("headers = %v, want %d", headers, tt.headers)
+			}
+		})
+	}
+
+	// broken policies are not applied, the previous ones are kept
+	if err := os.WriteFile(file, []byte("package authz\ndecision := {"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.load(); err == nil {
+		t.Fatal("broken policy is loaded")
+	}
+
+	if err := os.WriteFile(file, []byte("package authz\nother := true"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.load(); err != nil {
+		t.Fatal(err)
+	}
+	d, err := engine.Evaluate(context.Background(), &policyInput{User: &policyUser{Roles: []string{"ADMIN"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Allow {
+		t.Error("undefined decision allows the request")
+	}
+}
@@ -5,69 +5,95 @@ import (
 	"sync"
 	"time"
 
+	"envoy.apiconf"
 	"github.com/tel-io/tel/v2"
 )
 
+// RateLimitManager keeps counters of rate limits, the limits are taken from the config snapshot of the request
 type RateLimitManager struct {
 	logger *tel.Telemetry
-	rlConf map[string]*rateLimitConf
 
-	mx         *sync.Mutex
-	rlProgress map[string]*rateLimitProgress
+	mx             *sync.Mutex
+	rlProgress     map[string]*rateLimitProgress
+	clientProgress map[string]*clientRateProgress
+}
+
+type clientRateProgress struct {
+	Count     int
+	PeriodEnd time.Time
 }
 
 type rateLimitProgress struct {
 	IPRate    map[string]int
 	PeriodEnd time.Time
+	Limit     apiconf.RateLimitConf // the counters restart when the limit is changed
 }
 
-func NewRateLimitManager(conf *APIConf, logger *tel.Telemetry) *RateLimitManager {
-	rlConf := make(map[string]*rateLimitConf)
+func NewRateLimitManager(logger *tel.Telemetry) *RateLimitManager {
+	return &RateLimitManager{
+		logger: logger,
+
+		rlProgress:     make(map[string]*rateLimitProgress),
+		clientProgress: make(map[string]*clientRateProgress),
+		mx:             &sync.Mutex{},
+	}
+}
+
+func buildRateLimitConf(conf *apiconf.APIConf) map[string]*apiconf.RateLimitConf {
+	rlConf := make(map[string]*apiconf.RateLimitConf)
 
 	for _, api := range conf.APIsDescr {
 		for _, method := range api.Methods {
 			fullPath := fmt.Sprintf("%s/%s", api.Name, method.Name)
 
 			if method.Auth != nil && method.Auth.RateLimit != nil {
-				logger.Info("add rate limit config",
-					tel.String("method", fullPath), tel.Any("limit", method.Auth.RateLimit))
 				rlConf[fullPath] = method.Auth.RateLimit
 			}
 		}
 	}
 
-	return &RateLimitManager{
-		logger: logger,
-		rlConf: rlConf,
+	return rlConf
+}
+
+// UpdateConfig drops counters of methods whose limits are removed or changed by the reloaded config,
+// counters of methods with unchanged limits are kept
+func (rlm *RateLimitManager) UpdateConfig(conf *APIConf) {
+	for method, limit := range conf.rateLimits {
+		rlm.logger.Info("add rate limit config", tel.String("method", method), tel.Any("limit", limit))
+	}
+
+	rlm.mx.Lock()
+	defer rlm.mx.Unlock()
 
-		rlProgress: make(map[string]*rateLimitProgress),
-		mx:         &sync.Mutex{},
+	for method, progress := range rlm.rlProgress {
+		if cur := conf.rateLimits[method]; cur == nil || *cur != progress.Limit {
+			delete(rlm.rlProgress, method)
+		}
 	}
 }
 
-func (rlm *RateLimitManager) Check(ip, method string) bool {
-	cfg, ok := rlm.rlConf[method]
-	if !ok {
+// Check counts the request of the IP to the method, cfg is the limit of the method in the config of the request
+func (rlm *RateLimitManager) Check(ip, method string, cfg *apiconf.RateLimitConf) bool {
+	if cfg == nil {
 		//no need rate limit
 		return true
 	}
 
-	rlm.logger.Debug("checking rate limit for method=%s and IP=%s",
-		tel.String("method", method), tel.String("ip", ip))
-
 	rlm.mx.Lock()
 	defer rlm.mx.Unlock()
 
-	var progress *rateLimitProgress
+	rlm.logger.Debug("checking rate limit for method=%s and IP=%s",
+		tel.String("method", method), tel.String("ip", ip))
 
 	now := time.Now()
-	progress, ok = rlm.rlProgress[method]
-	if !ok || now.After(progress.PeriodEnd) {
+	progress, ok := rlm.rlProgress[method]
+	if !ok || now.After(progress.PeriodEnd) || progress.Limit != *cfg {
 		rlm.logger.Debug("create new rate limit progress", tel.String("method", method))
 
 		progress = &rateLimitProgress{
 			IPRate:    make(map[string]int),
 			PeriodEnd: now.Add(cfg.Period),
+			Limit:     *cfg,
 		}
 
 		rlm.rlProgress[method] = progress
@@ -75,6 +101,11 @@ func (rlm *RateLimitManager) Check(ip, method string) bool {
 
 	progress.IPRate[ip] += 1
 	if progress.IPRate[ip] > cfg.Count {
+		if cfg.Shadow() {
+			// the caller counts the request, it is let through without delay
+			return false
+		}
+
 		rlm.logger.Error("rate limit reached",
 			tel.String("method", method), tel.String("ip", ip))
 
@@ -89,6 +120,18 @@ func (rlm *RateLimitManager) Check(ip, method string) bool {
 	return true
 }
 
+// Size returns the number of IPs (summed over methods) and api key clients with counters
+func (rlm *RateLimitManager) Size() (ips int, clients int) {
+	rlm.mx.Lock()
+	defer rlm.mx.Unlock()
+
+	for _, p := range rlm.rlProgress {
+		ips += len(p.IPRate)
+	}
+
+	return ips, len(rlm.clientProgress)
+}
+
 func (rlm *RateLimitManager) Reset(ip, method string) {
 	rlm.mx.Lock()
 	defer rlm.mx.Unlock()
@@ -100,3 +143,28 @@ func (rlm *RateLimitManager) Reset(ip, method string) {
 
 	delete(progress.IPRate, ip)
 }
+
+// CheckClient applies the rate limit tier of an API key client, the limit is shared by all methods
+func (rlm *RateLimitManager) CheckClient(clientID string, cfg *apiconf.RateLimitConf) bool {
+	if cfg == nil {
+		return true
+	}
+
+	rlm.mx.Lock()
+	defer rlm.mx.Unlock()
+
+	now := time.Now()
+	progress, ok := rlm.clientProgress[clientID]
+	if !ok || now.After(progress.PeriodEnd) {
+		progress = &clientRateProgress{PeriodEnd: now.Add(cfg.Period)}
+		rlm.clientProgress[clientID] = progress
+	}
+
+	progress.Count += 1
+	if progress.Count > cfg.Count {
+		rlm.logger.Error("client rate limit reached", tel.String("client", clientID))
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tel-io/tel/v2"
+)
+
+func loadTestConfig(t *testing.T, data string) *APIConf {
+	t.Helper()
+
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := LoadConfig(file)
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+
+	return c
+}
+
+func TestRateLimitManagerUpdateConfig(t *testing.T) {
+	logger := tel.NewNull()
+	rlm := NewRateLimitManager(&logger)
+	prev := loadTestConfig(t, `
+apis:
+  - name: auth
+    auth: {policy: no-need}
+    methods:
+      - name: Login
+        auth: {policy: no-need, rate_limit: {period: 1m, count: 1}}
+      - name: Reset
+        auth: {policy: no-need, rate_limit: {period: 1m, count: 1}}
+      - name: Logout
+        auth: {policy: no-need, rate_limit: {period: 1m, count: 1}}
+`)
+	rlm.UpdateConfig(prev)
+
+	for _, m := range []string{"auth/Login", "auth/Reset", "auth/Logout"} {
+		if !rlm.Check("10.0.0.1", m, prev.rateLimits[m]) || rlm.Check("10.0.0.1", m, prev.rateLimits[m]) {
+			t.Fatalf("rate limit of %s is not applied", m)
+		}
+	}
+
+	cfg := loadTestConfig(t, `
+apis:
+  - name: auth
+    auth: {policy: no-need}
+    methods:
+      - name: Login
+        auth: {policy: no-need, rate_limit: {period: 1m, count: 1}}
+      - name: Reset
+        auth: {policy: no-need, rate_limit: {period: 1m, count: 5}}
+      - name: Logout
+        auth: {policy: no-need, rate_limit: {period: 1m, count: 5}}
+`)
+	// a check with the new snapshot restarts the counters of the changed limit before UpdateConfig
+	if !rlm.Check("10.0.0.1", "auth/Logout", cfg.rateLimits["auth/Logout"]) {
+		t.Errorf("counters of the previous limit are applied to the new one")
+	}
+
+	rlm.UpdateConfig(cfg)
+
+	if rlm.Check("10.0.0.1", "auth/Login", cfg.rateLimits["auth/Login"]) {
+		t.Errorf("counters of unchanged method are lost")
+	}
+	if !rlm.Check("10.0.0.1", "auth/Reset", cfg.rateLimits["auth/Reset"]) {
+		t.Errorf("counters of changed method are kept")
+	}
+	if ips, _ := rlm.Size(); ips != 3 {
+		t.Errorf("tracked IPs = %d, want 3", ips)
+	}
+}
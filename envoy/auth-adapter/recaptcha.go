@@ -1,17 +1,31 @@
 package main
 
 import (
-	"encoding/json"
-	"net/http"
-	"net/url"
-
+	"envoy.apiconf"
 	"github.com/tel-io/tel/v2"
 )
 
+// results of captcha verification, they label the auth_recaptcha_verifications_total metric
+const (
+	rcPassed        = "passed"
+	rcMissing       = "missing"
+	rcLowScore      = "low_score"
+	rcWrongAction   = "wrong_action"
+	rcWrongHostname = "wrong_hostname"
+	rcExpired       = "expired" // expired or already verified token
+	rcInvalid       = "invalid"
+	rcUnavailable   = "unavailable" // the verification service can't be called
+)
+
+// rcErrTimeoutOrDuplicate is the error code of tokens older than 2 minutes or verified before
+const rcErrTimeoutOrDuplicate = "timeout-or-duplicate"
+
+// RecaptchaResponse is the siteverify answer, hCaptcha and Turnstile answer in the same shape
 type RecaptchaResponse struct {
 	Success  bool     `json:"success"`
 	Score    *float64 `json:"score"`
 	Action   string   `json:"action"`
+	Hostname string   `json:"hostname"`
 	ErrCodes []string `json:"error-codes"`
 }
 
@@ -19,77 +33,66 @@ type RCConf struct {
 	URL      string
 	SecretV2 string
 	SecretV3 string
-	MinScore float64
+	MinScore float64 // of v3 tokens, methods can set their own
+
+	HCaptchaSecret  string
+	TurnstileSecret string
 }
 
 type RecaptchaProcessor struct {
-	httpCli  *http.Client
-	rcURL    string
+	siteVerifier
 	secretV2 string
 	secretV3 string
 	minScore float64
-	logger   *tel.Telemetry
 }
 
 func NewRecaptchaProcessor(rcConf *RCConf, logger *tel.Telemetry) *RecaptchaProcessor {
 	return &RecaptchaProcessor{
-		httpCli:  &http.Client{},
-		rcURL:    rcConf.URL,
-		secretV2: rcConf.SecretV2,
-		secretV3: rcConf.SecretV3,
-		minScore: rcConf.MinScore,
-		logger:   logger,
+		siteVerifier: newSiteVerifier(apiconf.CaptchaReCaptcha, rcConf.URL, logger),
+		secretV2:     rcConf.SecretV2,
+		secretV3:     rcConf.SecretV3,
+		minScore:     rcConf.MinScore,
 	}
 }
 
-func (rp *RecaptchaProcessor) CheckRecaptcha(token string, v2 bool) bool {
-	params := url.Values{}
+// Verify checks the token against the policy of the method, challenge tokens are v2 ones,
+// the score and the action are checked for v3 tokens only
+func (rp *RecaptchaProcessor) Verify(token string, v2 bool, policy apiconf.ReCaptchaConf) string {
+	secret := rp.secretV3
 	if v2 {
-		params.Set("secret", rp.secretV2)
-	} else {
-		params.Set("secret", rp.secretV3)
+		secret = rp.secretV2
 	}
-	params.Set("response", token)
 
-	log := rp.logger.With(tel.String("token_prefix", token[:20]))
+	return rp.verify(secret, token, v2, func(rcResp *RecaptchaResponse) string {
+		return rp.classify(rcResp, v2, policy)
+	})
+}
 
-	resp, err := rp.httpCli.PostForm(rp.rcURL, params)
-	if err != nil {
-		log.Error("RecaptchaProcessor", tel.String("POST", rp.rcURL), tel.Error(err))
-		return false
+func (rp *RecaptchaProcessor) classify(rcResp *RecaptchaResponse, v2 bool, policy apiconf.ReCaptchaConf) string {
+	if !rcResp.Success {
+		return failure(rcResp, rcErrTimeoutOrDuplicate)
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Error("RecaptchaProcessor failed", tel.String("POST", rp.rcURL),
-			tel.String("status", resp.Status))
-		return false
+	if !policy.AllowHostname(rcResp.Hostname) {
+		return rcWrongHostname
 	}
 
-	rcResp := RecaptchaResponse{}
-	err = json.NewDecoder(resp.Body).Decode(&rcResp)
-	if err != nil {
-		log.Error("RecaptchaProcessor json response decode failed", tel.Error(err))
-		return false
+	if v2 {
+		return rcPassed
 	}
 
-	if !rcResp.Success {
-		log.Warn("RecaptchaProcessor reCaptcha failed", tel.Any("resp", rcResp))
-		return false
-	} else {
-		log.Debug("RecaptchaProcessor reCaptcha response", tel.Any("resp", rcResp))
+	if rcResp.Score == nil {
+		// v2 tokens have no score, they are not accepted instead of v3 ones
+		return rcInvalid
 	}
 
-	if !v2 {
-		if rcResp.Score == nil {
-			log.Warn("RecaptchaProcessor <score> field does not found in v3 recaptcha", tel.Any("resp", rcResp))
-			return false
-		}
+	if policy.Action != "" && rcResp.Action != policy.Action {
+		return rcWrongAction
+	}
 
-		if *rcResp.Score < rp.minScore {
-			log.Info("RecaptchaProcessor reCaptcha v3", tel.Float64("score", *rcResp.Score))
-			return false
-		}
+	if *rcResp.Score < policy.GetMinScore(rp.minScore) {
+		return rcLowScore
 	}
 
-	return true
+	return rcPassed
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"envoy.apiconf"
+	"github.com/tel-io/tel/v2"
+)
+
+func TestCheckRecaptcha(t *testing.T) {
+	var answer RecaptchaResponse
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(answer)
+	}))
+	defer srv.Close()
+
+	logger := tel.NewNull()
+	rp := NewRecaptchaProcessor(&RCConf{URL: srv.URL, SecretV2: "v2", SecretV3: "v3", MinScore: 0.5}, &logger)
+
+	score := func(v float64) *float64 { return &v }
+	signup := apiconf.ReCaptchaConf{Enabled: true, MinScore: score(0.7), Action: "signup", Hostnames: []string{"example.com"}}
+
+	tests := []struct {
+		name   string
+		answer RecaptchaResponse
+		v2     bool
+		policy apiconf.ReCaptchaConf
+		want   string
+	}{
+		{
+			name:   "default min score",
+			answer: RecaptchaResponse{Success: true, Score: score(0.6), Action: "login", Hostname: "evil.com"},
+			policy: apiconf.ReCaptchaConf{Enabled: true},
+			want:   rcPassed,
+		},
+		{
+			name:   "method min score",
+			answer: RecaptchaResponse{Success: true, Score: score(0.6), Action: "signup", Hostname: "example.com"},
+			policy: signup,
+			want:   rcLowScore,
+		},
+		{
+			name:   "wrong action",
+			answer: RecaptchaResponse{Success: true, Score: score(0.9), Action: "login", Hostname: "example.com"},
+			policy: signup,
+			want:   rcWrongAction,
+		},
+		{
+			name:   "wrong hostname",
+			answer: RecaptchaResponse{Success: true, Score: score(0.9), Action: "signup", Hostname: "evil.com"},
+			policy: signup,
+			want:   rcWrongHostname,
+		},
+		{
+			name:   "passed",
+			answer: RecaptchaResponse{Success: true, Score: score(0.9), Action: "signup", Hostname: "example.com"},
+			policy: signup,
+			want:   rcPassed,
+		},
+		{
+			name:   "expired",
+			answer: RecaptchaResponse{ErrCodes: []string{"timeout-or-duplicate"}},
+			policy: signup,
+			want:   rcExpired,
+		},
+		{
+			name:   "invalid",
+			answer: RecaptchaResponse{ErrCodes: []string{"invalid-input-response"}},
+			policy: signup,
+			want:   rcInvalid,
+		},
+		{
+			name:   "v2 token instead of v3",
+			answer: RecaptchaResponse{Success: true, Hostname: "example.com"},
+			policy: signup,
+			want:   rcInvalid,
+		},
+		{
+			name:   "v2 checks hostname only",
+			answer: RecaptchaResponse{Success: true, Hostname: "example.com"},
+			v2:     true,
+			policy: signup,
+			want:   rcPassed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer = tt.answer
+			if got := rp.Verify("token", tt.v2, tt.policy); got != tt.want {
+				t.Errorf("Verify() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,13 +2,18 @@ package main
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"envoy.apiconf"
 	"envoy.auth/extAuth"
 	"github.com/golang/protobuf/ptypes/wrappers"
 	grpcx "github.com/tel-io/instrumentation/middleware/grpc"
 	"github.com/tel-io/tel/v2"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -25,20 +30,174 @@ import (
 )
 
 type server struct {
-	conn    *grpc.ClientConn
-	client  extAuth.AuthSessionServiceClient
-	authCfg *APIConf
-	logger  *tel.Telemetry
+	conn       *grpc.ClientConn
+	validators map[string]extAuth.AuthSessionServiceClient
+	caches     []tokenCache
+	authCfg    atomic.Pointer[APIConf]
+	logger     *tel.Telemetry
 
-	recaptchaProcessor *RecaptchaProcessor
-	disabledRecaptcha  bool
+	// deadline of ValidateSession calls
+	backendTimeout time.Duration
+
+	// by provider, providers without secrets have no verifier
+	captchaVerifiers map[string]CaptchaVerifier
+	// invalid reCaptcha settings keep the adapter not ready
+	rcConfErr error
 
 	rateLimitManager *RateLimitManager
+	apiKeyStore      *APIKeyStore
+	policyEngine     *PolicyEngine
+	auditLog         *AuditLog
+	metrics          *adapterMetrics
+
+	// set on shutdown, the adapter is not ready while in-flight checks are drained
+	draining atomic.Bool
 }
 
 var _ envoy_service_auth_v3.AuthorizationServer = &server{}
 
+// tokenCache keeps validation results of tokens: the session cache and the introspection client
+type tokenCache interface {
+	Revoke(token string)
+	RevokeSession(sessionID string) int
+}
+
 func NewServer(logger *tel.Telemetry, extAuthAddr string, authCfg *APIConf, rcConf *RCConf) (*server, error) {
+	var (
+		conn *grpc.ClientConn
+		err  error
+	)
+	validators := make(map[string]extAuth.AuthSessionServiceClient)
+	for _, mode := range authCfg.Validators() {
+		switch mode {
+		case apiconf.ValidatorJWT:
+			// tokens are validated locally, the auth service is not called at all
+			logger.Info("jwt token validator is used", tel.Any("config", authCfg.TokenValidator.JWT))
+			validators[mode] = extAuth.NewJWTValidator(*authCfg.TokenValidator.JWT)
+		case apiconf.ValidatorIntrospection:
+			logger.Info("introspection token validator is used", tel.String("url", authCfg.TokenValidator.Introspection.URL))
+			validators[mode] = extAuth.NewIntrospectionClient(*authCfg.TokenValidator.Introspection)
+		default:
+			var client extAuth.AuthSessionServiceClient
+			conn, client, err = dialSessionService(extAuthAddr)
+			if err != nil {
+				return nil, err
+			}
+			validators[apiconf.ValidatorSession] = client
+		}
+	}
+
+	metrics, err := newAdapterMetrics()
+	if err != nil {
+		return nil, fmt.Errorf("create metrics: %w", err)
+	}
+
+	// jwt tokens are checked locally, breaker and cache make sense for remote validators only
+	var caches []tokenCache
+	for mode, client := range validators {
+		if mode == apiconf.ValidatorJWT {
+			continue
+		}
+		if introspection, ok := client.(*extAuth.IntrospectionClient); ok {
+			caches = append(caches, introspection)
+		}
+
+		if authCfg.AuthBackend != nil && authCfg.AuthBackend.CircuitBreaker != nil {
+			breaker := extAuth.NewCircuitBreaker(client, *authCfg.AuthBackend.CircuitBreaker)
+			breaker.OnStateChange = breakerStateLogger(logger, metrics, mode)
+			client = breaker
+		}
+
+		if authCfg.SessionCache != nil {
+			cache := extAuth.NewSessionCache(client, *authCfg.SessionCache)
+			cache.CallTimeout = authCfg.AuthBackend.GetTimeout()
+			if err := metrics.WatchSessionCache(mode, cache); err != nil {
+				return nil, fmt.Errorf("create metrics: %w", err)
+			}
+			caches = append(caches, cache)
+			client = cache
+		}
+
+		validators[mode] = client
+	}
+
+	// RECAPTCHA_URL overrides the endpoint of the config
+	if rcConf.URL == "" && authCfg.Captcha != nil && authCfg.Captcha.ReCaptcha != nil {
+		rcConf.URL = authCfg.Captcha.ReCaptcha.URL
+	}
+	rcConfErr := rcConf.Validate()
+	if rcConfErr != nil {
+		logger.Error("invalid recaptcha config", tel.Error(rcConfErr))
+	}
+	captchaVerifiers := newCaptchaVerifiers(authCfg.Captcha, rcConf, logger)
+	if len(captchaVerifiers) == 0 {
+		logger.Warn("captcha is switched off")
+	}
+
+	var apiKeyStore *APIKeyStore
+	if authCfg.APIKeys != nil {
+		apiKeyStore, err = NewAPIKeyStore(authCfg.APIKeys, logger)
+		if err != nil {
+			return nil, fmt.Errorf("load api keys: %w", err)
+		}
+	}
+
+	var policyEngine *PolicyEngine
+	if authCfg.PolicyEngine != nil {
+		policyEngine, err = NewPolicyEngine(authCfg.PolicyEngine, logger)
+		if err != nil {
+			return nil, fmt.Errorf("load policies: %w", err)
+		}
+	}
+
+	var auditLog *AuditLog
+	if authCfg.Audit != nil {
+		auditLog, err = NewAuditLog(context.Background(), authCfg.Audit, logger)
+		if err != nil {
+			return nil, fmt.Errorf("open audit log: %w", err)
+		}
+	}
+
+	s := &server{
+		conn:       conn,
+		validators: validators,
+		caches:     caches,
+		logger:     logger,
+
+		backendTimeout: authCfg.AuthBackend.GetTimeout(),
+
+		captchaVerifiers: captchaVerifiers,
+		rcConfErr:        rcConfErr,
+
+		rateLimitManager: NewRateLimitManager(logger),
+		apiKeyStore:      apiKeyStore,
+		policyEngine:     policyEngine,
+		auditLog:         auditLog,
+		metrics:          metrics,
+	}
+	s.authCfg.Store(authCfg)
+	s.rateLimitManager.UpdateConfig(authCfg)
+
+	if err := s.captchaProvidersErr(authCfg); err != nil {
+		logger.Warn("captcha checks of the rules are switched off", tel.Error(err))
+	}
+
+	if err := metrics.WatchRateLimiter(s.rateLimitManager); err != nil {
+		return nil, fmt.Errorf("create metrics: %w", err)
+	}
+
+	return s, nil
+}
+
+func breakerStateLogger(logger *tel.Telemetry, metrics *adapterMetrics, backend string) func(from, to extAuth.BreakerState) {
+	return func(from, to extAuth.BreakerState) {
+		logger.Warn("auth backend circuit breaker state is changed",
+			tel.String("backend", backend), tel.String("from", from.String()), tel.String("to", to.String()))
+		metrics.BreakerTransition(backend, from.String(), to.String())
+	}
+}
+
+func dialSessionService(extAuthAddr string) (*grpc.ClientConn, extAuth.AuthSessionServiceClient, error) {
 	conn, err := grpc.Dial(
 		extAuthAddr,
 		grpc.WithInsecure(),
@@ -50,38 +209,161 @@ func NewServer(logger *tel.Telemetry, extAuthAddr string, authCfg *APIConf, rcCo
 		grpc.WithChainUnaryInterceptor(grpcx.UnaryClientInterceptorAll()),
 	)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	var (
-		recaptchaProcessor *RecaptchaProcessor
-		disabledRecaptcha  bool
-	)
-	if rcConf.URL == "" {
-		// disable recaptcha in this case
-		logger.Warn("recaptcha is switched off")
-		disabledRecaptcha = true
-	} else {
-		recaptchaProcessor = NewRecaptchaProcessor(rcConf, logger)
+	return conn, extAuth.NewAuthSessionServiceClient(conn), nil
+}
+
+func (s *server) config() *APIConf {
+	return s.authCfg.Load()
+}
+
+// Reload atomically replaces auth rules and rate limits with the config snapshot. Validators, session cache, auth backend,
+// api keys store, policy engine, audit log and captcha verifiers are created on start, their settings are applied after restart.
+func (s *server) Reload(cfg *APIConf) error {
+	for _, mode := range cfg.Validators() {
+		if _, ok := s.validators[mode]; !ok {
+			return fmt.Errorf("token validator %s is not started, restart is required", mode)
+		}
+	}
+
+	if cfg.APIKeys != nil && s.apiKeyStore == nil {
+		return fmt.Errorf("api keys store is not started, restart is required")
+	}
+
+	if cfg.PolicyEngine != nil && s.policyEngine == nil {
+		return fmt.Errorf("policy engine is not started, restart is required")
 	}
 
-	return &server{
-		conn:    conn,
-		client:  extAuth.NewAuthSessionServiceClient(conn),
-		authCfg: authCfg,
-		logger:  logger,
+	if cfg.Audit != nil && s.auditLog == nil {
+		return fmt.Errorf("audit log is not started, restart is required")
+	}
+
+	prev := s.config()
+	if !reflect.DeepEqual(prev.TokenValidator, cfg.TokenValidator) || !reflect.DeepEqual(prev.SessionCache, cfg.SessionCache) ||
+		!reflect.DeepEqual(prev.AuthBackend, cfg.AuthBackend) || !reflect.DeepEqual(prev.APIKeys, cfg.APIKeys) ||
+		!reflect.DeepEqual(prev.PolicyEngine, cfg.PolicyEngine) || !reflect.DeepEqual(prev.Audit, cfg.Audit) ||
+		!reflect.DeepEqual(prev.AuthAdapter, cfg.AuthAdapter) || !reflect.DeepEqual(prev.Captcha, cfg.Captcha) {
+		s.logger.Warn("token_validator, session_cache, auth_backend, api_keys, policy_engine, audit, auth_adapter " +
+			"and captcha changes are applied after restart")
+	}
 
-		recaptchaProcessor: recaptchaProcessor,
-		disabledRecaptcha:  disabledRecaptcha,
+	if err := s.captchaProvidersErr(cfg); err != nil {
+		s.logger.Warn("captcha checks of the rules are switched off", tel.Error(err))
+	}
+
+	// rules and rate limits are published together, then stale counters are dropped
+	s.authCfg.Store(cfg)
+	s.rateLimitManager.UpdateConfig(cfg)
 
-		rateLimitManager: NewRateLimitManager(authCfg, logger),
-	}, nil
+	return nil
+}
+
+// captchaProvidersErr reports the providers used by the rules which are not enabled, their checks pass
+// without tokens. Nothing is reported when no provider is enabled and captcha is switched off as a whole.
+func (s *server) captchaProvidersErr(cfg *APIConf) error {
+	if len(s.captchaVerifiers) == 0 {
+		return nil
+	}
+
+	var disabled []string
+	for _, provider := range cfg.UsedCaptchaProviders() {
+		if _, ok := s.captchaVerifiers[provider]; !ok {
+			disabled = append(disabled, provider)
+		}
+	}
+	if len(disabled) > 0 {
+		return fmt.Errorf("captcha providers %s are used by the config but not enabled", strings.Join(disabled, ", "))
+	}
+
+	return nil
+}
+
+// validatorFor returns the token validator selected for the API and its mode
+func (s *server) validatorFor(reqPermission *apiconf.AuthConf) (extAuth.AuthSessionServiceClient, string) {
+	mode := reqPermission.Validator
+	if mode == "" {
+		mode = s.config().TokenValidator.DefaultMode()
+	}
+
+	return s.validators[mode], mode
+}
+
+// validateResult is the result label of ValidateSession metrics
+func validateResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case extAuth.IsUnavailable(err):
+		return "unavailable"
+	case extAuth.IsCanceled(err):
+		return "canceled"
+	default:
+		return "invalid"
+	}
+}
+
+// RevokeToken evicts the token from session caches and the introspection cache
+func (s *server) RevokeToken(token string) {
+	for _, c := range s.caches {
+		c.Revoke(token)
+	}
+}
+
+// RevokeSession evicts all cached tokens of the session, the result is the number of evicted entries
+func (s *server) RevokeSession(sessionID string) int {
+	evicted := 0
+	for _, c := range s.caches {
+		evicted += c.RevokeSession(sessionID)
+	}
+
+	return evicted
 }
 
 func (s *server) Close() error {
+	if s.apiKeyStore != nil {
+		s.apiKeyStore.Close()
+	}
+
+	if s.policyEngine != nil {
+		s.policyEngine.Close()
+	}
+
+	if s.auditLog != nil {
+		s.auditLog.Close()
+	}
+
+	if s.conn == nil {
+		return nil
+	}
+
 	return s.conn.Close()
 }
 
+// identityHeaders are set by the adapter only, allowed requests lose the ones sent by clients
+var identityHeaders = []string{"user-id", "session-id", "client-id", "service-id"}
+
+// unsetIdentityHeaders returns identity headers the allowed request doesn't get from the adapter,
+// Envoy removes headers_to_remove after setting the headers of the response
+func unsetIdentityHeaders(headers []*envoy_api_v3_core.HeaderValueOption) []string {
+	var res []string
+	for _, name := range identityHeaders {
+		set := false
+		for _, h := range headers {
+			if h.GetHeader().GetKey() == name {
+				set = true
+				break
+			}
+		}
+		if !set {
+			res = append(res, name)
+		}
+	}
+
+	return res
+}
+
 func formCheckResponse(code v3.StatusCode, message string, headers []*envoy_api_v3_core.HeaderValueOption) *envoy_service_auth_v3.CheckResponse {
 	resp := &envoy_service_auth_v3.CheckResponse{}
 
@@ -89,7 +371,7 @@ func formCheckResponse(code v3.StatusCode, message string, headers []*envoy_api_
 		// Allow request
 		resp.Status = &status1.Status{Code: int32(code1.Code_OK), Message: message}
 		resp.HttpResponse = &envoy_service_auth_v3.CheckResponse_OkResponse{
-			OkResponse: &envoy_service_auth_v3.OkHttpResponse{Headers: headers},
+			OkResponse: &envoy_service_auth_v3.OkHttpResponse{Headers: headers, HeadersToRemove: unsetIdentityHeaders(headers)},
 		}
 	} else {
 		// Deny request - Status must be non-OK for Envoy to deny
@@ -105,7 +387,46 @@ func formCheckResponse(code v3.StatusCode, message string, headers []*envoy_api_
 	return resp
 }
 
+// Check authorizes the request, the decision is counted in metrics and written to the audit log when it is enabled
 func (s *server) Check(ctx context.Context, in *envoy_service_auth_v3.CheckRequest) (*envoy_service_auth_v3.CheckResponse, error) {
+	start := time.Now()
+	rec := &auditRecord{
+		Time:      start,
+		RequestID: in.GetAttributes().GetRequest().GetHttp().GetHeaders()["x-request-id"],
+	}
+
+	resp, err := s.check(ctx, in, rec)
+
+	latency := time.Since(start)
+	rec.LatencyMS = float64(latency.Microseconds()) / 1000
+	denied := resp.GetDeniedResponse()
+	switch {
+	case err != nil:
+		rec.Decision, rec.Reason = auditDeny, err.Error()
+	case denied != nil:
+		rec.Decision, rec.Status, rec.Reason = auditDeny, int(denied.GetStatus().GetCode()), resp.GetStatus().GetMessage()
+		if rec.Reason == "" {
+			rec.Reason = denied.GetStatus().GetCode().String()
+		}
+	default:
+		rec.Decision = auditAllow
+	}
+
+	// requests without a rule are not labelled with their path, it can be anything
+	if rec.Policy != "" {
+		s.metrics.Check(rec.Service, rec.rule, rec.Policy, rec.Decision, latency)
+	} else {
+		s.metrics.Check("", "", "", rec.Decision, latency)
+	}
+
+	if s.auditLog != nil {
+		s.auditLog.Write(rec)
+	}
+
+	return resp, err
+}
+
+func (s *server) check(ctx context.Context, in *envoy_service_auth_v3.CheckRequest, rec *auditRecord) (*envoy_service_auth_v3.CheckResponse, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
 		s.logger.Warn("cant receive gRPC metadata")
@@ -134,11 +455,15 @@ func (s *server) Check(ctx context.Context, in *envoy_service_auth_v3.CheckReque
 		return nil, st.Err()
 	}
 
-	service, method := parsePath(path)
+	// the whole check uses one config snapshot, reloads don't mix old and new rules and limits
+	cfg := s.config()
+	routeExt := in.Attributes.ContextExtensions
+	service, method, match := routeTarget(cfg.APIConf, in.Attributes.Request.Http.Method, path, routeExt)
 	s.logger.Debug("parsed path",
 		tel.String("path", path),
 		tel.String("service", service),
 		tel.String("method", method))
+	rec.Service, rec.Method = service, method
 	if service == "" || method == "" {
 		return formCheckResponse(v3.StatusCode_BadRequest, "bad path", respHeaders), nil
 	}
@@ -156,10 +481,12 @@ func (s *server) Check(ctx context.Context, in *envoy_service_auth_v3.CheckReque
 	if clientIP == "" {
 		s.logger.Warn("client IP not found in headers (x-real-ip or x-forwarded-for)")
 	}
+	rec.ClientIP = clientIP
 
 	v2RepatchaPassed := false
-	if !s.rateLimitManager.Check(clientIP, method) {
-		v2RepatchaPassed = s.checkReCaptcha(headers, true /*v2*/)
+	if limit := cfg.rateLimits[method]; !s.rateLimitManager.Check(clientIP, method, limit) &&
+		s.enforceRateLimit(method, limit) {
+		v2RepatchaPassed = s.checkReCaptcha(cfg, headers, true /*v2*/, match.Auth)
 		if v2RepatchaPassed {
 			s.rateLimitManager.Reset(clientIP, method)
 		} else {
@@ -167,30 +494,56 @@ func (s *server) Check(ctx context.Context, in *envoy_service_auth_v3.CheckReque
 		}
 	}
 
-	reqPermission := s.authCfg.GetRequestedPermissions(service, method)
+	reqPermission, err := routeRule(match.Auth, routeExt)
+	if err != nil {
+		s.logger.Warn("invalid auth of gateway route", tel.String("method", method), tel.Error(err))
+		return formCheckResponse(v3.StatusCode_BadRequest, "unknown auth for method", respHeaders), nil
+	}
 	s.logger.Debug("requested permissions",
-		tel.String("method", path), tel.Any("permissions", reqPermission))
+		tel.String("method", path), tel.String("rule_kind", match.Kind), tel.String("rule", match.Rule),
+		tel.Any("permissions", reqPermission))
 
 	if reqPermission == nil {
 		return formCheckResponse(v3.StatusCode_BadRequest, "unknown auth for method", respHeaders), nil
 	}
+	rec.Policy, rec.rule = reqPermission.Policy, match.Rule
+	if match.Kind == apiconf.RuleService {
+		rec.rule = ""
+	}
+
+	// denials of shadow rules are logged and counted, the request goes on
+	rule := ruleName(service, match)
+	enforce := func(reason string, code v3.StatusCode) bool {
+		return s.enforce(reqPermission.Shadow(), rule, reason, code)
+	}
 
 	if !v2RepatchaPassed && reqPermission.NeedReCaptcha() {
-		if !s.checkReCaptcha(headers, false /*v2*/) {
+		if !s.checkReCaptcha(cfg, headers, false /*v2*/, reqPermission) && enforce("recaptcha", v3.StatusCode_PreconditionFailed) {
 			return formCheckResponse(v3.StatusCode_PreconditionFailed, "", respHeaders), nil
 		}
 	}
+	if reqPermission.APIKey() {
+		return s.checkAPIKey(span, rec, headers, reqPermission, enforce, respHeaders), nil
+	}
+
+	if reqPermission.MTLS() {
+		return s.checkMTLS(span, rec, cfg.mtlsIndex, in.Attributes.Source, reqPermission, enforce, respHeaders), nil
+	}
+
 	// Always parse token first - even for no-need/optional policies
 	// If token is present, we MUST validate it and enrich headers
-	token, err := parseTokenCookie(headers["cookie"])
-	s.logger.Debug("token", tel.String("token", token), tel.Error(err))
+	tokenSources := reqPermission.GetTokenSources()
+	token, tokenSource, err := extractToken(tokenSources, headers, path)
+	s.logger.Debug("token", tel.String("token", token), tel.String("source", tokenSource), tel.Error(err))
 	if err != nil {
 		return formCheckResponse(v3.StatusCode_BadRequest, err.Error(), respHeaders), nil
 	}
+	span.SetAttributes(attribute.String("token_source", tokenSource))
+	rec.TokenSource = tokenSource
 
 	// No token provided
 	if token == "" {
-		if reqPermission.Required() {
+		if reqPermission.Required() && enforce("token_required", v3.StatusCode_Unauthorized) {
 			return formCheckResponse(v3.StatusCode_Unauthorized, "token required", respHeaders), nil
 		}
 		// NoNeed or Optional without token - allow through
@@ -202,23 +555,42 @@ func (s *server) Check(ctx context.Context, in *envoy_service_auth_v3.CheckReque
 	req := &extAuth.ValidateSessionRequest{
 		SessionToken: token,
 	}
-	resp, err := s.client.ValidateSession(
-		ccx,
-		req,
-		grpc.WaitForReady(true),
-	)
+	vctx, cancel := context.WithTimeout(ccx, s.backendTimeout)
+	defer cancel()
+	validator, mode := s.validatorFor(reqPermission)
+	validateStart := time.Now()
+	// the call fails fast while the auth service is down, so the breaker and on_auth_unavailable apply
+	resp, err := validator.ValidateSession(vctx, req)
+	s.metrics.ValidateSession(mode, validateResult(err), time.Since(validateStart))
 
 	s.logger.Debug("AuthService", tel.Any("response", resp), tel.Error(err))
 
+	if extAuth.IsCanceled(err) {
+		// Envoy or the client gave up, nothing is known about the token and nobody waits for the decision
+		return nil, status.Error(codes.Canceled, "request is canceled")
+	}
+
+	if err != nil && extAuth.IsUnavailable(err) {
+		// nothing is known about the token, so the cookie is kept
+		s.logger.Warn("auth backend is unavailable", tel.String("method", method), tel.Error(err))
+		if reqPermission.AllowAnonymousOnUnavailable() || !enforce("auth_unavailable", v3.StatusCode_ServiceUnavailable) {
+			return formCheckResponse(0, "", respHeaders), nil
+		}
+
+		return formCheckResponse(v3.StatusCode_ServiceUnavailable, "auth service is unavailable", respHeaders), nil
+	}
+
 	if err != nil {
-		// Token is invalid - clear the cookie
-		respHeaders = append(respHeaders, &envoy_api_v3_core.HeaderValueOption{
-			Header: &envoy_api_v3_core.HeaderValue{Key: "set-cookie", Value: "token=; Path=/; Max-Age=0; HttpOnly"},
-			Append: &wrappers.BoolValue{Value: false},
-		})
+		// Token is invalid - clear the cookie it came from
+		if cookie := tokenSourceCookie(tokenSources, tokenSource); cookie != "" {
+			respHeaders = append(respHeaders, &envoy_api_v3_core.HeaderValueOption{
+				Header: &envoy_api_v3_core.HeaderValue{Key: "set-cookie", Value: cookie + "=; Path=/; Max-Age=0; HttpOnly"},
+				Append: &wrappers.BoolValue{Value: false},
+			})
+		}
 
 		// For NoNeed or Optional - allow through even with invalid token
-		if reqPermission.NoNeed() || reqPermission.Optional() {
+		if reqPermission.NoNeed() || reqPermission.Optional() || !enforce("invalid_token", v3.StatusCode_Unauthorized) {
 			return formCheckResponse(0, "", respHeaders), nil
 		}
 
@@ -229,11 +601,54 @@ func (s *server) Check(ctx context.Context, in *envoy_service_auth_v3.CheckReque
 		attribute.String("userid", resp.UserId),
 		attribute.String("sessionid", resp.SessionId),
 	)
+	rec.UserID = resp.UserId
 
-	if reqPermission.Required() && !authorize(reqPermission.Permission, resp.Roles) {
+	grants := userGrants(resp.Roles)
+	if reqPermission.Required() && !reqPermission.Allows(grants, cfg.DefaultRoles()) &&
+		enforce("access_denied", v3.StatusCode_Forbidden) {
 		return formCheckResponse(v3.StatusCode_Forbidden, "access denied", respHeaders), nil
 	}
 
+	if s.policyEngine != nil {
+		decision, err := s.policyEngine.Evaluate(ccx, &policyInput{
+			Request: policyRequest{
+				Path:     path,
+				Method:   in.Attributes.Request.Http.Method,
+				Headers:  headers,
+				SourceIP: in.Attributes.Source.GetAddress().GetSocketAddress().GetAddress(),
+				ClientIP: clientIP,
+			},
+			Service: service,
+			Method:  method,
+			Rule: policyRule{
+				Kind:       match.Kind,
+				Name:       match.Rule,
+				Policy:     reqPermission.Policy,
+				Permission: reqPermission.Permission,
+			},
+			User: &policyUser{
+				ID:          resp.UserId,
+				SessionID:   resp.SessionId,
+				Roles:       grants.Roles,
+				Permissions: grants.Permissions,
+			},
+		})
+		if err != nil {
+			s.logger.Error("policy evaluation", tel.String("method", method), tel.Error(err))
+			return formCheckResponse(v3.StatusCode_InternalServerError, "policy evaluation failed", respHeaders), nil
+		}
+		s.logger.Debug("policy decision", tel.Any("decision", decision))
+
+		if !decision.Allow {
+			if enforce("policy", decision.StatusCode()) {
+				return formCheckResponse(decision.StatusCode(), decision.Message,
+					append(respHeaders, decision.ResponseHeaders()...)), nil
+			}
+		} else {
+			respHeaders = append(respHeaders, decision.ResponseHeaders()...)
+		}
+	}
+
 	respHeaders = append(respHeaders, &envoy_api_v3_core.HeaderValueOption{
 		Header: &envoy_api_v3_core.HeaderValue{Key: "user-id", Value: resp.UserId},
 		Append: &wrappers.BoolValue{Value: false},
@@ -247,21 +662,134 @@ func (s *server) Check(ctx context.Context, in *envoy_service_auth_v3.CheckReque
 	return formCheckResponse(0, "", respHeaders), nil
 }
 
-func (s *server) checkReCaptcha(headers map[string]string, v2 bool) bool {
-	if s.disabledRecaptcha {
+// checkAPIKey authorizes machine clients, they don't have sessions and are identified by the key only
+func (s *server) checkAPIKey(span trace.Span, rec *auditRecord, headers map[string]string, reqPermission *apiconf.AuthConf,
+	enforce denyEnforcer, respHeaders []*envoy_api_v3_core.HeaderValueOption) *envoy_service_auth_v3.CheckResponse {
+	var key string
+	if s.apiKeyStore != nil {
+		key = headers[s.apiKeyStore.conf.GetHeader()]
+	}
+	// the gateway route may ask for api key while the adapter config has no api_keys
+	if key == "" {
+		if enforce("api_key_required", v3.StatusCode_Unauthorized) {
+			return formCheckResponse(v3.StatusCode_Unauthorized, "api key required", respHeaders)
+		}
+		return formCheckResponse(0, "", respHeaders)
+	}
+
+	client, ok := s.apiKeyStore.Lookup(key)
+	if !ok {
+		if enforce("invalid_api_key", v3.StatusCode_Unauthorized) {
+			return formCheckResponse(v3.StatusCode_Unauthorized, "invalid api key", respHeaders)
+		}
+		return formCheckResponse(0, "", respHeaders)
+	}
+
+	span.SetAttributes(attribute.String("clientid", client.ClientID))
+	rec.ClientID = client.ClientID
+
+	if !reqPermission.Allows(client.Grants(), nil) && enforce("access_denied", v3.StatusCode_Forbidden) {
+		return formCheckResponse(v3.StatusCode_Forbidden, "access denied", respHeaders)
+	}
+
+	if !s.rateLimitManager.CheckClient(client.ClientID, client.rateLimit) {
+		s.metrics.RateLimitHit(rec.rule, "client", reqPermission.Shadow())
+		if enforce("rate_limit", v3.StatusCode_TooManyRequests) {
+			return formCheckResponse(v3.StatusCode_TooManyRequests, "rate limit is reached", respHeaders)
+		}
+	}
+
+	respHeaders = append(respHeaders, &envoy_api_v3_core.HeaderValueOption{
+		Header: &envoy_api_v3_core.HeaderValue{Key: "client-id", Value: client.ClientID},
+		Append: &wrappers.BoolValue{Value: false},
+	})
+
+	return formCheckResponse(0, "", respHeaders)
+}
+
+// checkMTLS authorizes service-to-service calls by the client certificate verified by Envoy
+func (s *server) checkMTLS(span trace.Span, rec *auditRecord, identities *mtlsIdentities, peer *envoy_service_auth_v3.AttributeContext_Peer,
+	reqPermission *apiconf.AuthConf, enforce denyEnforcer, respHeaders []*envoy_api_v3_core.HeaderValueOption) *envoy_service_auth_v3.CheckResponse {
+	identity, err := identities.Resolve(peer)
+	if err != nil {
+		s.logger.Debug("mtls identity", tel.Error(err))
+		if enforce("unknown_identity", v3.StatusCode_Unauthorized) {
+			return formCheckResponse(v3.StatusCode_Unauthorized, err.Error(), respHeaders)
+		}
+		return formCheckResponse(0, "", respHeaders)
+	}
+
+	span.SetAttributes(attribute.String("serviceid", identity.Service))
+	rec.ServiceID = identity.Service
+
+	if !reqPermission.Allows(identity.Grants(), nil) && enforce("access_denied", v3.StatusCode_Forbidden) {
+		return formCheckResponse(v3.StatusCode_Forbidden, "access denied", respHeaders)
+	}
+
+	respHeaders = append(respHeaders, &envoy_api_v3_core.HeaderValueOption{
+		Header: &envoy_api_v3_core.HeaderValue{Key: "service-id", Value: identity.Service},
+		Append: &wrappers.BoolValue{Value: false},
+	})
+
+	return formCheckResponse(0, "", respHeaders)
+}
+
+// denyEnforcer tells whether the denial of the rule must be returned
+type denyEnforcer func(reason string, code v3.StatusCode) bool
+
+// enforce tells whether the denial must be returned, denials of shadow rules are logged and counted
+// in the auth_shadow_denials metric instead
+func (s *server) enforce(shadow bool, rule, reason string, code v3.StatusCode) bool {
+	if !shadow {
 		return true
 	}
 
-	hName := "x-rc-token"
+	s.logger.Info("shadow rule would deny the request",
+		tel.String("rule", rule), tel.String("reason", reason), tel.Int("status", int(code)))
+	s.metrics.ShadowDenial(rule, reason, int(code))
+
+	return false
+}
+
+// enforceRateLimit counts the rate limit hit of the method and tells whether it is enforced
+func (s *server) enforceRateLimit(method string, limit *apiconf.RateLimitConf) bool {
+	shadow := limit.Shadow()
+	s.metrics.RateLimitHit(method, "ip", shadow)
+
+	return s.enforce(shadow, method, "rate_limit", v3.StatusCode_TooManyRequests)
+}
+
+// checkReCaptcha verifies the token of the rule's captcha provider, v2 tokens are the challenge
+// ones passing rate limits. Token headers of the providers are set in the config.
+func (s *server) checkReCaptcha(cfg *APIConf, headers map[string]string, v2 bool, auth *apiconf.AuthConf) bool {
+	var policy apiconf.ReCaptchaConf
+	if auth != nil {
+		policy = auth.ReCaptcha
+	}
+
+	provider := cfg.CaptchaProvider(auth)
+	// checks of the providers which are not enabled are switched off
+	verifier, ok := s.captchaVerifiers[provider]
+	if !ok {
+		s.logger.Debug("captcha provider is not enabled", tel.String("provider", provider))
+		return true
+	}
+
+	providerConf := cfg.Captcha.ProviderConf(provider)
+	hName := providerConf.TokenHeader
 	if v2 {
-		hName = "x-rc-token-2"
+		hName = providerConf.ChallengeHeader
 	}
 
-	token, ok := headers[hName]
+	token, ok := headers[strings.ToLower(hName)]
 	if !ok {
 		s.logger.Debug("header is not passed", tel.String("name", hName))
+		s.metrics.Recaptcha(provider, v2, rcMissing)
 		return false
 	}
 
-	return s.recaptchaProcessor.CheckRecaptcha(token, v2)
+	result := verifier.Verify(token, v2, policy)
+	s.metrics.Recaptcha(provider, v2, result)
+
+	return result == rcPassed
 }
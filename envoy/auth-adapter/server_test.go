@@ -0,0 +1,310 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"envoy.apiconf"
+	"envoy.auth/extAuth"
+	"github.com/tel-io/tel/v2"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	envoy_service_auth_v3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	v3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+)
+
+func checkRequest(path string, headers map[string]string) *envoy_service_auth_v3.CheckRequest {
+	return &envoy_service_auth_v3.CheckRequest{
+		Attributes: &envoy_service_auth_v3.AttributeContext{
+			Request: &envoy_service_auth_v3.AttributeContext_Request{
+				Http: &envoy_service_auth_v3.AttributeContext_HttpRequest{
+					Method:  "POST",
+					Path:    path,
+					Headers: headers,
+				},
+			},
+		},
+	}
+}
+
+// responseHeader returns the header which Check adds to the allowed request
+func responseHeader(resp *envoy_service_auth_v3.CheckResponse, key string) string {
+	for _, h := range resp.GetOkResponse().GetHeaders() {
+		if h.Header.Key == key {
+			return h.Header.Value
+		}
+	}
+
+	return ""
+}
+
+// removesHeader tells whether the allowed request loses the header sent by the client
+func removesHeader(resp *envoy_service_auth_v3.CheckResponse, key string) bool {
+	for _, h := range resp.GetOkResponse().GetHeadersToRemove() {
+		if h == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newTestServer returns the adapter with the demo session validator, no captcha providers
+// and cfg loaded, tests set other components themselves
+func newTestServer(t *testing.T, cfg *APIConf) *server {
+	t.Helper()
+
+	logger := tel.NewNull()
+	metrics, err := newAdapterMetrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{
+		validators:       map[string]extAuth.AuthSessionServiceClient{apiconf.ValidatorSession: extAuth.NewAuthSessionServiceClient(nil)},
+		logger:           &logger,
+		backendTimeout:   apiconf.DefaultAuthBackendTimeout,
+		rateLimitManager: NewRateLimitManager(&logger),
+		metrics:          metrics,
+	}
+	s.authCfg.Store(cfg)
+
+	return s
+}
+
+// unreachableRecaptcha enables reCaptcha for tests of requests without captcha tokens
+func unreachableRecaptcha() map[string]CaptchaVerifier {
+	logger := tel.NewNull()
+	return map[string]CaptchaVerifier{
+		apiconf.CaptchaReCaptcha: NewRecaptchaProcessor(&RCConf{URL: "http://127.0.0.1:1/siteverify"}, &logger),
+	}
+}
+
+func TestCheckShadowMode(t *testing.T) {
+	cfg := loadTestConfig(t, `
+apis:
+  - name: Users
+    methods:
+      - name: Delete
+        auth: {policy: required, permission: "user:delete", mode: shadow}
+      - name: Update
+        auth: {policy: required, permission: "user:delete"}
+      - name: Search
+        auth: {policy: no-need, rate_limit: {period: 1m, count: 1, mode: shadow}}
+      - name: Login
+        auth: {policy: no-need, rate_limit: {period: 1m, count: 1}}
+`)
+	s := newTestServer(t, cfg)
+	// without x-rc-token-2 the rate limit can't be passed with reCaptcha v2
+	s.captchaVerifiers = unreachableRecaptcha()
+
+	token := map[string]string{"authorization": "Bearer demo-token", "x-real-ip": "10.0.0.1"}
+	anonymous := map[string]string{"x-real-ip": "10.0.0.1"}
+
+	tests := []struct {
+		name    string
+		path    string
+		headers map[string]string
+		want    v3.StatusCode
+	}{
+		{name: "shadow without token", path: "/api/Users/Delete", headers: anonymous},
+		{name: "enforce without token", path: "/api/Users/Update", headers: anonymous, want: v3.StatusCode_Unauthorized},
+		{name: "shadow without permission", path: "/api/Users/Delete", headers: token},
+		{name: "enforce without permission", path: "/api/Users/Update", headers: token, want: v3.StatusCode_Forbidden},
+		{name: "shadow rate limit", path: "/api/Users/Search", headers: anonymous},
+		{name: "shadow rate limit is reached", path: "/api/Users/Search", headers: anonymous},
+		{name: "enforced rate limit", path: "/api/Users/Login", headers: anonymous},
+		{name: "enforced rate limit is reached", path: "/api/Users/Login", headers: anonymous, want: v3.StatusCode_TooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.Check(context.Background(), checkRequest(tt.path, tt.headers))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			denied := resp.GetDeniedResponse()
+			var got v3.StatusCode
+			if denied != nil {
+				got = denied.Status.Code
+			}
+			if got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// identity of the shadow denied user is still passed upstream
+	resp, err := s.Check(context.Background(), checkRequest("/api/Users/Delete", token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if responseHeader(resp, "user-id") == "" {
+		t.Error("user-id header is not set for the shadow denied request")
+	}
+}
+
+func TestCheckIdentityHeadersRemoved(t *testing.T) {
+	cfg := loadTestConfig(t, `
+apis:
+  - name: Users
+    methods:
+      - name: Get
+        auth: {policy: optional}
+      - name: Delete
+        auth: {policy: required, mode: shadow}
+`)
+	s := newTestServer(t, cfg)
+
+	spoofed := map[string]string{"user-id": "admin", "session-id": "s", "client-id": "billing", "service-id": "ledger"}
+	withToken := map[string]string{"authorization": "Bearer demo-token", "client-id": "billing"}
+
+	tests := []struct {
+		name       string
+		path       string
+		headers    map[string]string
+		wantRemove []string
+	}{
+		{name: "optional without token", path: "/api/Users/Get", headers: spoofed, wantRemove: identityHeaders},
+		{name: "optional with invalid token", path: "/api/Users/Get",
+			headers: map[string]string{"authorization": "Bearer wrong", "client-id": "billing"}, wantRemove: identityHeaders},
+		{name: "optional with token", path: "/api/Users/Get", headers: withToken, wantRemove: []string{"client-id", "service-id"}},
+		{name: "shadow token required", path: "/api/Users/Delete", headers: spoofed, wantRemove: identityHeaders},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := s.Check(context.Background(), checkRequest(tt.path, tt.headers))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ok := resp.GetOkResponse()
+			if ok == nil {
+				t.Fatalf("request is denied: %v", resp.GetDeniedResponse())
+			}
+			if got := ok.GetHeadersToRemove(); !reflect.DeepEqual(got, tt.wantRemove) {
+				t.Errorf("headers to remove = %v, want %v", got, tt.wantRemove)
+			}
+		})
+	}
+}
+
+// failingClient is a session service which fails every call with err
+type failingClient struct {
+	err   error
+	calls int
+}
+
+func (c *failingClient) ValidateSession(context.Context, *extAuth.ValidateSessionRequest, ...grpc.CallOption) (
+	*extAuth.ValidateSessionResponse, error) {
+	c.calls++
+	return nil, c.err
+}
+
+func TestCheckAuthUnavailable(t *testing.T) {
+	cfg := loadTestConfig(t, `
+apis:
+  - name: Users
+    methods:
+      - name: Get
+        auth: {policy: required, permission: read}
+      - name: List
+        auth: {policy: optional}
+      - name: Search
+        auth: {policy: optional, on_auth_unavailable: deny}
+  - name: Orders
+    auth: {policy: optional, on_auth_unavailable: allow_anonymous}
+    methods:
+      - name: Update
+        auth: {policy: required, permission: write}
+`)
+	s := newTestServer(t, cfg)
+	backend := &failingClient{err: status.Error(codes.Unavailable, "connection refused")}
+	breaker := extAuth.NewCircuitBreaker(backend, extAuth.CircuitBreakerConfig{FailureThreshold: 3, OpenTimeout: time.Minute})
+	s.validators[apiconf.ValidatorSession] = breaker
+
+	token := map[string]string{"authorization": "Bearer demo-token", "cookie": "token=demo-token"}
+	check := func(path string) *envoy_service_auth_v3.CheckResponse {
+		t.Helper()
+		resp, err := s.Check(context.Background(), checkRequest(path, token))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	statusOf := func(resp *envoy_service_auth_v3.CheckResponse) v3.StatusCode {
+		if denied := resp.GetDeniedResponse(); denied != nil {
+			return denied.Status.Code
+		}
+		return 0
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want v3.StatusCode
+	}{
+		{name: "required denies by default", path: "/api/Users/Get", want: v3.StatusCode_ServiceUnavailable},
+		{name: "optional allows anonymous by default", path: "/api/Users/List"},
+		{name: "deny", path: "/api/Users/Search", want: v3.StatusCode_ServiceUnavailable},
+		{name: "required doesn't inherit allow_anonymous", path: "/api/Orders/Update", want: v3.StatusCode_ServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := check(tt.path)
+			if got := statusOf(resp); got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+			if responseHeader(resp, "user-id") != "" {
+				t.Error("identity headers are set without the validated token")
+			}
+			for _, h := range append(resp.GetOkResponse().GetHeaders(), resp.GetDeniedResponse().GetHeaders()...) {
+				if h.Header.Key == "set-cookie" {
+					t.Error("token cookie is cleared while the backend is unavailable")
+				}
+			}
+		})
+	}
+
+	// the breaker opened after 3 failures, the backend is not called anymore
+	if breaker.State() != extAuth.BreakerOpen {
+		t.Fatalf("breaker state = %s, want open", breaker.State())
+	}
+	calls := backend.calls
+	if got := statusOf(check("/api/Users/Get")); got != v3.StatusCode_ServiceUnavailable {
+		t.Errorf("open breaker: status = %v, want %v", got, v3.StatusCode_ServiceUnavailable)
+	}
+	if got := statusOf(check("/api/Users/List")); got != 0 {
+		t.Errorf("open breaker: optional status = %v, want allowed", got)
+	}
+	if backend.calls != calls {
+		t.Errorf("backend is called while the breaker is open")
+	}
+}
+
+func TestCheckCanceled(t *testing.T) {
+	cfg := loadTestConfig(t, `
+apis:
+  - name: Users
+    methods:
+      - name: Get
+        auth: {policy: required, permission: read}
+`)
+	s := newTestServer(t, cfg)
+	breaker := extAuth.NewCircuitBreaker(&failingClient{err: context.Canceled}, extAuth.CircuitBreakerConfig{FailureThreshold: 1})
+	s.validators[apiconf.ValidatorSession] = breaker
+
+	_, err := s.Check(context.Background(), checkRequest("/api/Users/Get", map[string]string{"authorization": "Bearer demo-token"}))
+	if status.Code(err) != codes.Canceled {
+		t.Errorf("Check() error = %v, want Canceled", err)
+	}
+	if breaker.State() != extAuth.BreakerClosed {
+		t.Errorf("canceled check opened the breaker")
+	}
+}
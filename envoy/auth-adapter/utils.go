@@ -1,19 +1,57 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 
+	"envoy.apiconf"
 	"envoy.auth/extAuth"
 )
 
-func parseTokenCookie(raw string) (string, error) {
+// extractToken looks for the session token in the sources in their priority order
+// and returns it with the name of the source it was found in
+func extractToken(sources []apiconf.TokenSourceConf, headers map[string]string, path string) (token, source string, err error) {
+	for _, ts := range sources {
+		switch {
+		case ts.Cookie != "":
+			token, err = parseCookie(headers["cookie"], ts.Cookie)
+			if err != nil {
+				return "", ts.String(), err
+			}
+		case ts.Header != "":
+			token = parseHeaderToken(headers[strings.ToLower(ts.Header)], ts.Scheme)
+		case ts.Query != "":
+			token = parseQueryToken(path, ts.Query)
+		}
+
+		if token != "" {
+			return token, ts.String(), nil
+		}
+	}
+
+	return "", "", nil
+}
+
+// tokenSourceCookie returns the cookie name if the token was taken from a cookie
+func tokenSourceCookie(sources []apiconf.TokenSourceConf, source string) string {
+	for _, ts := range sources {
+		if ts.Cookie != "" && ts.String() == source {
+			return ts.Cookie
+		}
+	}
+
+	return ""
+}
+
+func parseCookie(raw, name string) (string, error) {
 	header := http.Header{}
 	header.Add("Cookie", raw)
 	request := http.Request{Header: header}
-	c, err := request.Cookie("token")
+	c, err := request.Cookie(name)
 
 	if err == http.ErrNoCookie {
 		return "", nil
@@ -26,45 +64,136 @@ func parseTokenCookie(raw string) (string, error) {
 	return c.Value, nil
 }
 
-func authorize(perm string, roles []*extAuth.Role) bool {
-	for _, r := range roles {
-		// hack for "CLIENT" role (user on the site)
-		if perm == "" && r.Name == "CLIENT" {
-			return true
-		}
+func parseHeaderToken(value, scheme string) string {
+	value = strings.TrimSpace(value)
+	if scheme == "" {
+		return value
+	}
+
+	// auth scheme is case-insensitive (RFC 7235)
+	if len(value) <= len(scheme) || !strings.EqualFold(value[:len(scheme)], scheme) || value[len(scheme)] != ' ' {
+		return ""
+	}
+
+	return strings.TrimSpace(value[len(scheme):])
+}
+
+func parseQueryToken(path, param string) string {
+	idx := strings.Index(path, "?")
+	if idx == -1 {
+		return ""
+	}
+
+	query, err := url.ParseQuery(path[idx+1:])
+	if err != nil {
+		return ""
+	}
+
+	return query.Get(param)
+}
 
+// userGrants returns the user roles and permissions of all of them
+func userGrants(roles []*extAuth.Role) apiconf.Grants {
+	var g apiconf.Grants
+	for _, r := range roles {
+		g.Roles = append(g.Roles, r.Name)
 		for _, p := range r.Permissions {
-			if p.Name == perm {
-				return true
-			}
+			g.Permissions = append(g.Permissions, p.Name)
 		}
 	}
 
-	return false
+	return g
 }
 
-func parsePath(path string) (service string, method string) {
+// splitPath splits /{api_route}/{service}/{path} path, the longest matching prefix wins
+func splitPath(path string, prefixes []string) (service string, rest string) {
 	// Remove query string if present
 	if idx := strings.Index(path, "?"); idx != -1 {
 		path = path[:idx]
 	}
 
-	parts := strings.Split(path, "/")
-	// Expected format: /api/{service}/{method}/...
-	// parts[0] = "", parts[1] = "api", parts[2] = service, parts[3] = method
-	if len(parts) < 4 {
-		return
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+
+		// Expected format: {service}/{method}/...
+		service, rest, _ = strings.Cut(path[len(prefix):], "/")
+		if service == "" || rest == "" || rest[0] == '/' {
+			return "", ""
+		}
+
+		return service, rest
+	}
+
+	return "", ""
+}
+
+// routeTarget returns the requested service, method and the rule matched for it. The gateway passes
+// the service and the method in ext_authz context extensions, when they are missing (catch-all
+// routes, older gateway configs) the request verb and path are matched against the config methods.
+func routeTarget(c *apiconf.APIConf, verb, path string, ext map[string]string) (service, method string,
+	match apiconf.RuleMatch) {
+	pathService, rest := splitPath(path, c.APIPrefixes())
+
+	service, name := ext[apiconf.ContextExtService], ext[apiconf.ContextExtMethod]
+	if service != "" && name != "" {
+		if pathService != service {
+			// the gateway prefix is unknown to the adapter, pattern rules are matched by the method name
+			rest = name
+		}
+		return service, fmt.Sprintf("%s/%s", service, name), c.MatchRule(service, name, rest)
+	}
+
+	if pathService == "" || service != "" && service != pathService {
+		return "", "", apiconf.RuleMatch{}
 	}
 
-	// Verify this is an /api/ path
-	if parts[1] != "api" {
-		return
+	if m := c.MatchMethod(pathService, verb, rest); m != nil {
+		return pathService, fmt.Sprintf("%s/%s", pathService, m.Name), c.MatchRule(pathService, m.Name, rest)
 	}
 
-	service = parts[2]
-	method = fmt.Sprintf("%s/%s", service, parts[3])
+	// the API catch-all route, the first path segment names the method in logs and rate limits
+	first, _, _ := strings.Cut(rest, "/")
+	return pathService, fmt.Sprintf("%s/%s", pathService, first), c.MatchRule(pathService, "", rest)
+}
+
+// ruleName names the matched rule in logs and metrics: the API or the method or the pattern of the API
+func ruleName(service string, match apiconf.RuleMatch) string {
+	if match.Kind == "" || match.Kind == apiconf.RuleService {
+		return service
+	}
+
+	return service + "/" + match.Rule
+}
+
+// routeRule applies policy and permission of the gateway route to the configured rule,
+// the gateway takes them from the same config, so they differ only while one of them is not reloaded yet
+func routeRule(rule *apiconf.AuthConf, ext map[string]string) (*apiconf.AuthConf, error) {
+	policy, hasPolicy := ext[apiconf.ContextExtPolicy]
+	if !hasPolicy {
+		return rule, nil
+	}
+
+	res := &apiconf.AuthConf{}
+	if rule != nil {
+		*res = *rule
+	}
+	res.Policy = policy
+	res.Permission = ext[apiconf.ContextExtPermission]
+	res.Permissions = nil
+	if raw, ok := ext[apiconf.ContextExtPermissions]; ok {
+		res.Permissions = &apiconf.PermissionExpr{}
+		if err := json.Unmarshal([]byte(raw), res.Permissions); err != nil {
+			return nil, fmt.Errorf("invalid permissions: %w", err)
+		}
+	}
+
+	if err := res.Validate(); err != nil {
+		return nil, err
+	}
 
-	return
+	return res, nil
 }
 
 func getEnvVar(varName, defaultVal string) string {
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"os"
 	"testing"
+
+	"envoy.apiconf"
+	"gopkg.in/yaml.v3"
 )
 
-func TestParsePath(t *testing.T) {
+func TestRouteTargetPath(t *testing.T) {
 	tests := []struct {
 		name           string
 		path           string
@@ -75,13 +79,276 @@ func TestParsePath(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotService, gotMethod := parsePath(tt.path)
+			// methods which are not configured are named by the first path segment
+			gotService, gotMethod, _ := routeTarget(&apiconf.APIConf{}, "POST", tt.path, nil)
 			if gotService != tt.wantService {
-				t.Errorf("parsePath(%q) service = %q, want %q", tt.path, gotService, tt.wantService)
+				t.Errorf("routeTarget(%q) service = %q, want %q", tt.path, gotService, tt.wantService)
 			}
 			if gotMethod != tt.wantMethod {
-				t.Errorf("parsePath(%q) method = %q, want %q", tt.path, gotMethod, tt.wantMethod)
+				t.Errorf("routeTarget(%q) method = %q, want %q", tt.path, gotMethod, tt.wantMethod)
+			}
+		})
+	}
+}
+
+func TestExtractToken(t *testing.T) {
+	sources := []apiconf.TokenSourceConf{
+		{Cookie: "token"},
+		{Header: "Authorization", Scheme: "Bearer"},
+		{Header: "x-auth-token"},
+		{Query: "access_token"},
+	}
+
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		path       string
+		wantToken  string
+		wantSource string
+	}{
+		{
+			name:       "cookie has priority",
+			headers:    map[string]string{"cookie": "a=b; token=cookie-token", "authorization": "Bearer header-token"},
+			path:       "/api/svc/method",
+			wantToken:  "cookie-token",
+			wantSource: "cookie:token",
+		},
+		{
+			name:       "bearer token",
+			headers:    map[string]string{"authorization": "bearer header-token"},
+			path:       "/api/svc/method",
+			wantToken:  "header-token",
+			wantSource: "header:authorization",
+		},
+		{
+			name:       "other authorization scheme is skipped",
+			headers:    map[string]string{"authorization": "Basic dXNlcjpwYXNz", "x-auth-token": "custom-token"},
+			path:       "/api/svc/method",
+			wantToken:  "custom-token",
+			wantSource: "header:x-auth-token",
+		},
+		{
+			name:       "query param",
+			headers:    map[string]string{},
+			path:       "/api/svc/ws?access_token=query-token",
+			wantToken:  "query-token",
+			wantSource: "query:access_token",
+		},
+		{
+			name:    "no token",
+			headers: map[string]string{"cookie": "a=b"},
+			path:    "/api/svc/method",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, source, err := extractToken(sources, tt.headers, tt.path)
+			if err != nil {
+				t.Fatalf("extractToken() error = %v", err)
+			}
+			if token != tt.wantToken || source != tt.wantSource {
+				t.Errorf("extractToken() = %q, %q, want %q, %q", token, source, tt.wantToken, tt.wantSource)
+			}
+		})
+	}
+}
+
+// apiRouteCase is shared with the generator tests, see envoy/testdata/api_routes.yaml
+type apiRouteCase struct {
+	Name     string    `yaml:"name"`
+	APIRoute apiconf.APIRoutes `yaml:"api_route"`
+	Path     string    `yaml:"path"`
+	Service  string    `yaml:"service"`
+	Method   string    `yaml:"method"`
+}
+
+func TestRouteTargetAPIRoutes(t *testing.T) {
+	data, err := os.ReadFile("../testdata/api_routes.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cases []apiRouteCase
+	if err := yaml.Unmarshal(data, &cases); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.Name, func(t *testing.T) {
+			cfg := &apiconf.APIConf{APIRoute: tt.APIRoute}
+			gotService, gotMethod, _ := routeTarget(cfg, "POST", tt.Path, nil)
+			if gotService != tt.Service || gotMethod != tt.Method {
+				t.Errorf("routeTarget(%q, %v) = %q, %q, want %q, %q",
+					tt.Path, tt.APIRoute, gotService, gotMethod, tt.Service, tt.Method)
+			}
+		})
+	}
+}
+
+func TestRouteTarget(t *testing.T) {
+	cfg, err := apiconf.Parse([]byte(`
+apis:
+  - name: FakeService
+    auth: {policy: optional}
+    methods:
+      - name: Handle
+        auth: {policy: required}
+      - name: List*
+        auth: {policy: optional, permission: "fake:list"}
+  - name: PaymentAPI
+    auth: {policy: required}
+    methods:
+      - name: charge
+        verb: POST
+        auth: {policy: required, permission: "payment:charge"}
+      - name: refund
+        verb: POST
+        path: orders/{id}/refund
+        auth: {policy: required, permission: "payment:refund"}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		verb           string
+		path           string
+		ext            map[string]string
+		wantService    string
+		wantMethod     string
+		wantPermission string
+	}{
+		{
+			name:        "method route",
+			path:        "/gateway/FakeService/Handle",
+			ext:         map[string]string{"service": "FakeService", "method": "Handle"},
+			wantService: "FakeService",
+			wantMethod:  "FakeService/Handle",
+		},
+		{
+			name:        "catch-all route",
+			path:        "/api/FakeService/Other",
+			ext:         map[string]string{"service": "FakeService"},
+			wantService: "FakeService",
+			wantMethod:  "FakeService/Other",
+		},
+		{
+			name:        "catch-all route of another service",
+			path:        "/api/OtherService/Other",
+			ext:         map[string]string{"service": "FakeService"},
+			wantService: "",
+			wantMethod:  "",
+		},
+		{
+			name:        "no extensions",
+			path:        "/api/FakeService/Handle",
+			wantService: "FakeService",
+			wantMethod:  "FakeService/Handle",
+		},
+		{
+			name:           "pattern rule",
+			path:           "/api/FakeService/ListItems",
+			ext:            map[string]string{"service": "FakeService"},
+			wantService:    "FakeService",
+			wantMethod:     "FakeService/ListItems",
+			wantPermission: "fake:list",
+		},
+		{
+			name:           "verb",
+			verb:           "POST",
+			path:           "/api/PaymentAPI/charge",
+			wantService:    "PaymentAPI",
+			wantMethod:     "PaymentAPI/charge",
+			wantPermission: "payment:charge",
+		},
+		{
+			name:        "another verb gets the API rule",
+			verb:        "GET",
+			path:        "/api/PaymentAPI/charge",
+			wantService: "PaymentAPI",
+			wantMethod:  "PaymentAPI/charge",
+		},
+		{
+			name:           "path template",
+			verb:           "POST",
+			path:           "/api/PaymentAPI/orders/42/refund?reason=duplicate",
+			wantService:    "PaymentAPI",
+			wantMethod:     "PaymentAPI/refund",
+			wantPermission: "payment:refund",
+		},
+		{
+			name:        "path template of another verb",
+			verb:        "GET",
+			path:        "/api/PaymentAPI/orders/42/refund",
+			wantService: "PaymentAPI",
+			wantMethod:  "PaymentAPI/orders",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verb := tt.verb
+			if verb == "" {
+				verb = "POST"
+			}
+
+			gotService, gotMethod, match := routeTarget(cfg, verb, tt.path, tt.ext)
+			if gotService != tt.wantService || gotMethod != tt.wantMethod {
+				t.Errorf("routeTarget(%s %q, %v) = %q, %q, want %q, %q",
+					verb, tt.path, tt.ext, gotService, gotMethod, tt.wantService, tt.wantMethod)
+			}
+			if match.Auth != nil && match.Auth.Permission != tt.wantPermission {
+				t.Errorf("routeTarget(%s %q) permission = %q, want %q", verb, tt.path, match.Auth.Permission, tt.wantPermission)
 			}
 		})
 	}
 }
+
+func TestRouteRule(t *testing.T) {
+	rule := &apiconf.AuthConf{Policy: apiconf.PolicyOptional, ReCaptcha: apiconf.ReCaptchaConf{Enabled: true}}
+
+	got, err := routeRule(rule, nil)
+	if err != nil || got != rule {
+		t.Fatalf("routeRule without extensions = %+v, %v, want the configured rule", got, err)
+	}
+
+	got, err = routeRule(rule, map[string]string{"policy": "required", "permission": "user:read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Required() || got.Permission != "user:read" || !got.NeedReCaptcha() {
+		t.Errorf("routeRule = %+v, want required user:read with reCaptcha", got)
+	}
+	if !rule.Optional() {
+		t.Errorf("configured rule is modified: %+v", rule)
+	}
+
+	got, err = routeRule(rule, map[string]string{"policy": "required", "permissions": `{"all_of":["user:read"],"roles":["ADMIN"]}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Permissions == nil || len(got.Permissions.AllOf) != 1 || len(got.Permissions.Roles) != 1 {
+		t.Errorf("routeRule permissions = %+v, want all_of user:read and role ADMIN", got.Permissions)
+	}
+
+	withExpr := &apiconf.AuthConf{Policy: apiconf.PolicyRequired, Permissions: &apiconf.PermissionExpr{AnyOf: []string{"admin"}}}
+	got, err = routeRule(withExpr, map[string]string{"policy": "required"})
+	if err != nil || got.Permissions != nil {
+		t.Errorf("routeRule keeps the expression the route doesn't have: %+v, %v", got, err)
+	}
+
+	if _, err := routeRule(rule, map[string]string{"policy": "required", "permissions": "any_of"}); err == nil {
+		t.Error("routeRule accepts invalid permissions")
+	}
+
+	got, err = routeRule(nil, map[string]string{"policy": "no-need"})
+	if err != nil || got == nil || !got.NoNeed() {
+		t.Errorf("routeRule for method unknown to the adapter = %+v, %v, want no-need", got, err)
+	}
+
+	if _, err := routeRule(rule, map[string]string{"policy": "unknown"}); err == nil {
+		t.Error("routeRule accepts unknown policy")
+	}
+}